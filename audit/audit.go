@@ -0,0 +1,135 @@
+// Package audit detects sensitive data such as card numbers, API keys and private keys within text.
+package audit
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Detector finds one kind of sensitive data.
+type Detector struct {
+	Name string
+	re   *regexp.Regexp
+	// valid filters out matches that look right but aren't, such as card numbers failing the Luhn check.
+	valid func(match string) bool
+}
+
+// Detectors are the built in Detectors, used when none are chosen.
+var Detectors = []Detector{
+	{Name: "card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	{Name: "aws-key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{Name: "github-token", re: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{Name: "slack-token", re: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{Name: "stripe-key", re: regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{16,}\b`)},
+	{Name: "google-api-key", re: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{Name: "openai-key", re: regexp.MustCompile(`\bsk-(?:proj-)?[A-Za-z0-9_-]{20,}\b`)},
+	{Name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\b`)},
+	// the header isn't secret itself, so the empty group leaves nothing to redact
+	{Name: "private-key", re: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY-----()`)},
+	{Name: "password", re: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|secret)\s*[:=]\s*(\S+)`)},
+}
+
+// ParseDetector returns the built in Detector with the given name, or a custom one given as name=regex using https://pkg.go.dev/regexp/syntax.
+// Like the built in ones, if the regex has a capture group only the first is redacted from Findings.
+func ParseDetector(s string) (Detector, error) {
+	if name, pattern, ok := strings.Cut(s, "="); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return Detector{}, errors.Wrapf(err, "regexp.Compile")
+		}
+		return Detector{Name: name, re: re}, nil
+	}
+	i := slices.IndexFunc(Detectors, func(d Detector) bool { return d.Name == s })
+	if i == -1 {
+		names := make([]string, len(Detectors))
+		for i, d := range Detectors {
+			names[i] = d.Name
+		}
+		return Detector{}, errors.Errorf("unknown detector %q, expected name=regex or one of %v", s, names)
+	}
+	return Detectors[i], nil
+}
+
+// Finding is sensitive data found within text.
+type Finding struct {
+	Detector string `json:"detector"`
+	// Match is the text that was found, with the secret part redacted so the report doesn't leak it further.
+	Match string `json:"match"`
+	// Start and End are the byte offsets of the unredacted match within the text.
+	Start int `json:"-"`
+	End   int `json:"-"`
+}
+
+// Scan returns what detectors find within text, in the order of detectors.
+func Scan(text string, detectors []Detector) []Finding {
+	var findings []Finding
+	for _, d := range detectors {
+		for _, loc := range d.re.FindAllStringSubmatchIndex(text, -1) {
+			match := text[loc[0]:loc[1]]
+			if d.valid != nil && !d.valid(match) {
+				continue
+			}
+			// redact the first capture group if there is one, otherwise the whole match
+			secretStart, secretEnd := loc[0], loc[1]
+			if len(loc) > 2 && loc[2] != -1 {
+				secretStart, secretEnd = loc[2], loc[3]
+			}
+			findings = append(findings, Finding{
+				Detector: d.Name,
+				Match:    text[loc[0]:secretStart] + redact(text[secretStart:secretEnd]) + text[secretEnd:loc[1]],
+				Start:    loc[0],
+				End:      loc[1],
+			})
+		}
+	}
+	return findings
+}
+
+// redact masks all but the last 4 letters and digits of a secret, keeping separators so it's still recognizable.
+func redact(secret string) string {
+	runes := []rune(secret)
+	kept := 0
+	for i := len(runes) - 1; i >= 0; i-- {
+		if !isAlnum(runes[i]) {
+			continue
+		}
+		if kept < 4 && len(runes) > 8 {
+			kept++
+			continue
+		}
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+func isAlnum(r rune) bool {
+	return r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// luhn reports whether the digits within s have a valid Luhn check digit, and are as many as a card number has.
+func luhn(s string) bool {
+	var digits []int
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		// every second digit from the right is doubled
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
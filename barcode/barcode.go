@@ -0,0 +1,54 @@
+// Package barcode finds and decodes the QR codes and barcodes within images, such as the links on posters or the numbers on receipts and tickets.
+// It's pure Go and meant for flat, upright images like screenshots and scans; photos work when the code is large, sharp and faces the camera.
+package barcode
+
+import (
+	"image"
+	"io"
+	"slices"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Format is a kind of barcode.
+type Format string
+
+const (
+	QR      Format = "qr"
+	EAN13   Format = "ean13"
+	EAN8    Format = "ean8"
+	UPCA    Format = "upca"
+	Code128 Format = "code128"
+	Code39  Format = "code39"
+)
+
+// Code is a decoded QR code or barcode.
+type Code struct {
+	Format Format
+	// Text is the code's payload, such as a URL or the digits of a product number.
+	Text string
+}
+
+// Scan decodes a JPEG or PNG image and returns the codes within it, see ScanImage.
+func Scan(r io.Reader) ([]Code, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "image.Decode")
+	}
+	return ScanImage(img), nil
+}
+
+// ScanImage returns the codes within img, each only once even if it appears several times.
+func ScanImage(img image.Image) []Code {
+	bm := binarize(img)
+	codes := scanQR(bm)
+	codes = append(codes, scanLinear(bm)...)
+
+	var unique []Code
+	for _, c := range codes {
+		if !slices.Contains(unique, c) {
+			unique = append(unique, c)
+		}
+	}
+	return unique
+}
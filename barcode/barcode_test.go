@@ -0,0 +1,73 @@
+package barcode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestScanImageNothing(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	noise := func(w, h int) image.Image {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(r.IntN(256))
+		}
+		return img
+	}
+	blocks := func(w, h, size int) image.Image {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				if (x/size+y/size)%2 == 0 || r.IntN(8) == 0 {
+					img.SetGray(x, y, color.Gray{Y: 255})
+				}
+			}
+		}
+		return img
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"empty", image.NewGray(image.Rect(0, 0, 0, 0))},
+		{"1x1", image.NewGray(image.Rect(0, 0, 1, 1))},
+		{"3x3 noise", noise(3, 3)},
+		{"1 pixel tall", noise(500, 1)},
+		{"1 pixel wide", noise(1, 500)},
+		{"offset bounds", image.NewGray(image.Rect(-50, 30, 20, 90))},
+		{"noise", noise(400, 300)},
+		{"checkerboard", blocks(300, 300, 4)},
+		{"white", blocks(200, 200, 1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if codes := ScanImage(tt.img); len(codes) != 0 {
+				t.Fatalf("got %+v", codes)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	modules := encodeEAN13("4006381333931")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderLinear(modules, 3, false)); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := Scan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 1 || codes[0] != (Code{Format: EAN13, Text: "4006381333931"}) {
+		t.Fatalf("got %+v", codes)
+	}
+
+	if _, err = Scan(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Fatal("scanning something that isn't an image succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package barcode
+
+import (
+	"image"
+)
+
+// bitmap is a black and white image, with dark pixels set.
+type bitmap struct {
+	w, h int
+	dark []bool
+}
+
+func (b *bitmap) at(x, y int) bool {
+	if x < 0 || y < 0 || x >= b.w || y >= b.h {
+		return false
+	}
+	return b.dark[y*b.w+x]
+}
+
+// binarize converts img to a bitmap by comparing each pixel to the average brightness around it, so shadows and gradients across photos don't hide codes.
+// Pixels much darker than their surroundings or just plain dark are set.
+func binarize(img image.Image) *bitmap {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	lum := make([]uint8, w*h)
+	// integral holds the sum of every pixel above and left of each position, so the average of any window takes 4 lookups
+	integral := make([]int64, (w+1)*(h+1))
+	for y := range h {
+		var rowSum int64
+		for x := range w {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			// Rec. 601 luma, like ocr.dHash
+			l := uint8((299*r + 587*g + 114*b) / 1000 >> 8)
+			lum[y*w+x] = l
+			rowSum += int64(l)
+			integral[(y+1)*(w+1)+x+1] = integral[y*(w+1)+x+1] + rowSum
+		}
+	}
+
+	// the window must be wider than a QR code's finder pattern centers or they'd blend into their surroundings
+	radius := max(8, min(w, h)/16)
+	bm := &bitmap{w: w, h: h, dark: make([]bool, w*h)}
+	for y := range h {
+		y0, y1 := max(0, y-radius), min(h, y+radius+1)
+		for x := range w {
+			x0, x1 := max(0, x-radius), min(w, x+radius+1)
+			sum := integral[y1*(w+1)+x1] - integral[y0*(w+1)+x1] - integral[y1*(w+1)+x0] + integral[y0*(w+1)+x0]
+			count := int64((y1 - y0) * (x1 - x0))
+			l := int64(lum[y*w+x])
+			bm.dark[y*w+x] = l < 64 || l*count*100 < sum*88
+		}
+	}
+	return bm
+}
@@ -0,0 +1,445 @@
+package barcode
+
+import (
+	"math"
+	"slices"
+	"strings"
+)
+
+// linearLines is how many rows, and columns for barcodes printed sideways, are scanned for 1D barcodes.
+const linearLines = 128
+
+// quietModules is how many modules of light space must surround a 1D barcode, less than the standards ask for since images are often cropped close.
+const quietModules = 3
+
+// scanLinear looks for 1D barcodes along lines spread evenly across the image, in both directions so upside down ones are found too.
+func scanLinear(bm *bitmap) []Code {
+	var codes []Code
+	scan := func(line func(i int) bool, length int) {
+		lengths := runs(line, length)
+		codes = append(codes, decodeRuns(lengths)...)
+		codes = append(codes, decodeRuns(reverseRuns(lengths))...)
+	}
+	for y := range linearLines {
+		y = (y*2 + 1) * bm.h / (linearLines * 2)
+		scan(func(x int) bool { return bm.at(x, y) }, bm.w)
+	}
+	for x := range linearLines {
+		x = (x*2 + 1) * bm.w / (linearLines * 2)
+		scan(func(y int) bool { return bm.at(x, y) }, bm.h)
+	}
+	return codes
+}
+
+// reverseRuns reverses the runs of a line while keeping light runs at even indexes.
+func reverseRuns(lengths []int) []int {
+	reversed := slices.Clone(lengths)
+	slices.Reverse(reversed)
+	// the line started light, so an odd amount of runs means it ended light too
+	if len(lengths)%2 == 0 {
+		reversed = append([]int{0}, reversed...)
+	}
+	return reversed
+}
+
+// linearDecoder tries decoding a barcode starting at the dark run lengths[start], returning the index after it's last run.
+type linearDecoder func(lengths []int, start int) (Code, int, bool)
+
+// decodeRuns decodes the barcodes along a line from it's run lengths, starting with a light run.
+func decodeRuns(lengths []int) []Code {
+	var codes []Code
+	for i := 1; i < len(lengths); i += 2 {
+		for _, decode := range []linearDecoder{decodeEAN13, decodeEAN8, decodeCode128, decodeCode39} {
+			if code, end, ok := decode(lengths, i); ok {
+				codes = append(codes, code)
+				i = end - 1
+				break
+			}
+		}
+	}
+	return codes
+}
+
+// quiet reports whether the light runs before start and at end are wide enough to surround a barcode with module wide bars.
+func quiet(lengths []int, start, end int, module float64) bool {
+	if float64(lengths[start-1]) < module*quietModules {
+		return false
+	}
+	return end >= len(lengths) || float64(lengths[end]) >= module*quietModules
+}
+
+// matchWidths returns how far run lengths are from a pattern of module widths, in modules, after scaling them to the pattern's total width.
+func matchWidths(lengths []int, pattern []int) float64 {
+	var total, patternTotal int
+	for i := range pattern {
+		total += lengths[i]
+		patternTotal += pattern[i]
+	}
+	module := float64(total) / float64(patternTotal)
+	var diff float64
+	for i, p := range pattern {
+		diff += math.Abs(float64(lengths[i])/module - float64(p))
+	}
+	return diff
+}
+
+// bestMatch returns the index of the pattern closest to the run lengths, if it's close enough.
+func bestMatch(lengths []int, patterns [][]int, maxDiff float64) (int, bool) {
+	best, bestDiff := -1, maxDiff
+	for i, p := range patterns {
+		if d := matchWidths(lengths, p); d < bestDiff {
+			best, bestDiff = i, d
+		}
+	}
+	return best, best >= 0
+}
+
+// eanL are the widths of each digit's light, dark, light and dark runs in the left half of an EAN barcode with odd parity.
+// Right half digits use the same widths starting dark, and even parity left half digits are them reversed.
+var eanL = [][]int{
+	{3, 2, 1, 1}, {2, 2, 2, 1}, {2, 1, 2, 2}, {1, 4, 1, 1}, {1, 1, 3, 2},
+	{1, 2, 3, 1}, {1, 1, 1, 4}, {1, 3, 1, 2}, {1, 2, 1, 3}, {3, 1, 1, 2},
+}
+
+// eanLG is eanL followed by the even parity patterns.
+var eanLG = func() [][]int {
+	lg := slices.Clone(eanL)
+	for _, p := range eanL {
+		g := slices.Clone(p)
+		slices.Reverse(g)
+		lg = append(lg, g)
+	}
+	return lg
+}()
+
+// ean13FirstDigit maps the parity of an EAN-13's left half digits, with even parity bits set from the first, to it's implied first digit.
+var ean13FirstDigit = map[int]int{
+	0b000000: 0, 0b001011: 1, 0b001101: 2, 0b001110: 3, 0b010011: 4,
+	0b011001: 5, 0b011100: 6, 0b010101: 7, 0b010110: 8, 0b011010: 9,
+}
+
+// eanMaxDiff is how far a digit's run lengths may be from it's pattern, in modules.
+const eanMaxDiff = 1.5
+
+// decodeEANDigits reads count digits of 4 runs each from lengths, returning them and the parity of each.
+func decodeEANDigits(lengths []int, count int, patterns [][]int) (digits []int, parity int, ok bool) {
+	for d := range count {
+		match, ok := bestMatch(lengths[d*4:d*4+4], patterns, eanMaxDiff)
+		if !ok {
+			return nil, 0, false
+		}
+		digits = append(digits, match%10)
+		parity = parity<<1 | match/10
+	}
+	return digits, parity, true
+}
+
+// eanGuards reports whether the runs of an EAN barcode's guards are module wide, returning the module size.
+func eanGuards(lengths []int, start, middle, end int) (float64, bool) {
+	guards := [][]int{lengths[start : start+3], lengths[middle : middle+5], lengths[end : end+3]}
+	var total, count int
+	for _, g := range guards {
+		for _, l := range g {
+			total += l
+			count++
+		}
+	}
+	module := float64(total) / float64(count)
+	for _, g := range guards {
+		for _, l := range g {
+			if math.Abs(float64(l)-module) > module*0.6 {
+				return 0, false
+			}
+		}
+	}
+	return module, true
+}
+
+// eanChecksum reports whether the last digit is the check digit of the others, weighting digits alternately by 3 and 1 from the right.
+func eanChecksum(digits []int) bool {
+	sum := 0
+	for i, d := range digits[:len(digits)-1] {
+		if (len(digits)-1-i)%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10-sum%10)%10 == digits[len(digits)-1]
+}
+
+func formatDigits(digits []int) string {
+	var b strings.Builder
+	for _, d := range digits {
+		b.WriteByte(byte('0' + d))
+	}
+	return b.String()
+}
+
+// decodeEAN13 decodes an EAN-13 barcode, or a UPC-A which is one starting with 0.
+func decodeEAN13(lengths []int, start int) (Code, int, bool) {
+	// start guard, 6 digits, middle guard, 6 digits and end guard
+	end := start + 3 + 24 + 5 + 24 + 3
+	if end > len(lengths) {
+		return Code{}, 0, false
+	}
+	module, ok := eanGuards(lengths, start, start+27, start+56)
+	if !ok || !quiet(lengths, start, end, module) {
+		return Code{}, 0, false
+	}
+	left, parity, ok := decodeEANDigits(lengths[start+3:], 6, eanLG)
+	if !ok {
+		return Code{}, 0, false
+	}
+	first, ok := ean13FirstDigit[parity]
+	if !ok {
+		return Code{}, 0, false
+	}
+	right, _, ok := decodeEANDigits(lengths[start+32:], 6, eanL)
+	if !ok {
+		return Code{}, 0, false
+	}
+	digits := slices.Concat([]int{first}, left, right)
+	if !eanChecksum(digits) {
+		return Code{}, 0, false
+	}
+	if first == 0 {
+		return Code{Format: UPCA, Text: formatDigits(digits[1:])}, end, true
+	}
+	return Code{Format: EAN13, Text: formatDigits(digits)}, end, true
+}
+
+// decodeEAN8 decodes an EAN-8 barcode.
+func decodeEAN8(lengths []int, start int) (Code, int, bool) {
+	end := start + 3 + 16 + 5 + 16 + 3
+	if end > len(lengths) {
+		return Code{}, 0, false
+	}
+	module, ok := eanGuards(lengths, start, start+19, start+40)
+	if !ok || !quiet(lengths, start, end, module) {
+		return Code{}, 0, false
+	}
+	left, parity, ok := decodeEANDigits(lengths[start+3:], 4, eanLG)
+	if !ok || parity != 0 {
+		return Code{}, 0, false
+	}
+	right, _, ok := decodeEANDigits(lengths[start+24:], 4, eanL)
+	if !ok {
+		return Code{}, 0, false
+	}
+	digits := slices.Concat(left, right)
+	if !eanChecksum(digits) {
+		return Code{}, 0, false
+	}
+	return Code{Format: EAN8, Text: formatDigits(digits)}, end, true
+}
+
+// code128Patterns are the widths of each Code 128 symbol's dark, light, dark, light, dark and light runs, indexed by value.
+var code128Patterns = func() [][]int {
+	const widths = "212222 222122 222221 121223 121322 131222 122213 122312 132212 221213 " +
+		"221312 231212 112232 122132 122231 113222 123122 123221 223211 221132 " +
+		"221231 213212 223112 312131 311222 321122 321221 312212 322112 322211 " +
+		"212123 212321 232121 111323 131123 131321 112313 132113 132311 211313 " +
+		"231113 231311 112133 112331 132131 113123 113321 133121 313121 211331 " +
+		"231131 213113 213311 213131 311123 311321 331121 312113 312311 332111 " +
+		"314111 221411 431111 111224 111422 121124 121421 141122 141221 112214 " +
+		"112412 122114 122411 142112 142211 241211 221114 413111 241112 134111 " +
+		"111242 121142 121241 114212 124112 124211 411212 421112 421211 212141 " +
+		"214121 412121 111143 111341 131141 114113 114311 411113 411311 113141 " +
+		"114131 311141 411131 211412 211214 211232"
+	var patterns [][]int
+	for _, w := range strings.Fields(widths) {
+		p := make([]int, len(w))
+		for i, c := range w {
+			p[i] = int(c - '0')
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}()
+
+// code128Stop is the widths of the stop pattern, which has an extra dark run.
+var code128Stop = []int{2, 3, 3, 1, 1, 1, 2}
+
+// Code 128 symbol values that aren't characters.
+const (
+	code128FNC3   = 96
+	code128FNC2   = 97
+	code128Shift  = 98
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128CodeA  = 101
+	code128FNC1   = 102
+	code128StartA = 103
+	code128StartB = 104
+	code128StartC = 105
+)
+
+// code128MaxDiff is how far a symbol's run lengths may be from it's pattern, in modules.
+const code128MaxDiff = 2
+
+// decodeCode128 decodes a Code 128 barcode, validating it's check symbol.
+func decodeCode128(lengths []int, start int) (Code, int, bool) {
+	var values []int
+	i := start
+	for {
+		if i+7 <= len(lengths) && matchWidths(lengths[i:i+7], code128Stop) < code128MaxDiff {
+			i += 7
+			break
+		}
+		if i+6 > len(lengths) {
+			return Code{}, 0, false
+		}
+		v, ok := bestMatch(lengths[i:i+6], code128Patterns, code128MaxDiff)
+		if !ok || len(values) == 0 && v < code128StartA || len(values) > 0 && v >= code128StartA {
+			return Code{}, 0, false
+		}
+		values = append(values, v)
+		i += 6
+	}
+	// the start symbol, at least one character and the check symbol
+	if len(values) < 3 {
+		return Code{}, 0, false
+	}
+	var width int
+	for _, l := range lengths[start:i] {
+		width += l
+	}
+	module := float64(width) / float64(len(values)*11+13)
+	if !quiet(lengths, start, i, module) {
+		return Code{}, 0, false
+	}
+
+	sum := values[0]
+	for pos, v := range values[1 : len(values)-1] {
+		sum += (pos + 1) * v
+	}
+	if sum%103 != values[len(values)-1] {
+		return Code{}, 0, false
+	}
+	text, ok := code128Text(values[:len(values)-1])
+	return Code{Format: Code128, Text: text}, i, ok
+}
+
+// code128Text converts Code 128 symbol values, starting with the start symbol, to text. Function characters are left out.
+func code128Text(values []int) (string, bool) {
+	set := values[0]
+	var b strings.Builder
+	shift := false
+	for _, v := range values[1:] {
+		current := set
+		if shift {
+			// a shift switches between sets A and B for one character
+			current = code128StartA + code128StartB - set
+			shift = false
+		}
+		switch current {
+		case code128StartC:
+			switch {
+			case v < 100:
+				b.WriteByte(byte('0' + v/10))
+				b.WriteByte(byte('0' + v%10))
+			case v == code128CodeB:
+				set = code128StartB
+			case v == code128CodeA:
+				set = code128StartA
+			}
+			continue
+		case code128StartA:
+			switch {
+			case v < 64:
+				b.WriteByte(byte(' ' + v))
+				continue
+			case v < 96:
+				b.WriteByte(byte(v - 64))
+				continue
+			case v == code128CodeB:
+				set = code128StartB
+				continue
+			}
+		case code128StartB:
+			switch {
+			case v < 96:
+				b.WriteByte(byte(' ' + v))
+				continue
+			case v == code128CodeA:
+				set = code128StartA
+				continue
+			}
+		}
+		switch v {
+		case code128Shift:
+			shift = true
+		case code128CodeC:
+			set = code128StartC
+		}
+	}
+	return b.String(), b.Len() > 0
+}
+
+// code39Alphabet are the characters Code 39 encodes, with * being the start and stop character.
+const code39Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%*"
+
+// code39Patterns are each character's 9 runs, dark first, as bits with wide runs set, most significant first.
+var code39Patterns = []int{
+	0x034, 0x121, 0x061, 0x160, 0x031, 0x130, 0x070, 0x025, 0x124, 0x064,
+	0x109, 0x049, 0x148, 0x019, 0x118, 0x058, 0x00d, 0x10c, 0x04c, 0x01c,
+	0x103, 0x043, 0x142, 0x013, 0x112, 0x052, 0x007, 0x106, 0x046, 0x016,
+	0x181, 0x0c1, 0x1c0, 0x091, 0x190, 0x0d0, 0x085, 0x184, 0x0c4, 0x0a8,
+	0x0a2, 0x08a, 0x02a, 0x094,
+}
+
+// code39Char reads the character whose 9 runs start at lengths[i], which has 3 wide runs clearly wider than the rest.
+func code39Char(lengths []int, i int) (byte, bool) {
+	if i+9 > len(lengths) {
+		return 0, false
+	}
+	run := lengths[i : i+9]
+	sorted := slices.Clone(run)
+	slices.Sort(sorted)
+	narrow, wide := sorted[5], sorted[6]
+	if float64(wide) < float64(narrow)*1.6 {
+		return 0, false
+	}
+	pattern := 0
+	for _, l := range run {
+		pattern <<= 1
+		if l >= wide {
+			pattern |= 1
+		}
+	}
+	idx := slices.Index(code39Patterns, pattern)
+	if idx < 0 {
+		return 0, false
+	}
+	return code39Alphabet[idx], true
+}
+
+// decodeCode39 decodes a Code 39 barcode, which starts and ends with *.
+func decodeCode39(lengths []int, start int) (Code, int, bool) {
+	if c, ok := code39Char(lengths, start); !ok || c != '*' {
+		return Code{}, 0, false
+	}
+	var text []byte
+	// each character is followed by a light gap
+	for i := start + 10; ; i += 10 {
+		c, ok := code39Char(lengths, i)
+		if !ok {
+			return Code{}, 0, false
+		}
+		if c != '*' {
+			text = append(text, c)
+			continue
+		}
+		end := i + 9
+		var width int
+		for _, l := range lengths[start:end] {
+			width += l
+		}
+		// each character is 3 wide and 6 narrow runs plus a gap, about 16 modules
+		module := float64(width) / float64((len(text)+2)*16)
+		if len(text) == 0 || !quiet(lengths, start, end, module) {
+			return Code{}, 0, false
+		}
+		return Code{Format: Code39, Text: string(text)}, end, true
+	}
+}
@@ -0,0 +1,128 @@
+package barcode
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// eanLCodes are the odd parity left half digit modules from the EAN-13 standard, with 1 for dark.
+var eanLCodes = []string{"0001101", "0011001", "0010011", "0111101", "0100011", "0110001", "0101111", "0111011", "0110111", "0001011"}
+
+// eanParity is the parity of the left half digits for each first digit, with G for even.
+var eanParity = []string{"LLLLLL", "LLGLGG", "LLGGLG", "LLGGGL", "LGLLGG", "LGGLLG", "LGGGLL", "LGLGLG", "LGLGGL", "LGGLGL"}
+
+// encodeEAN13 returns the modules of an EAN-13 barcode for 13 digits, including the check digit.
+func encodeEAN13(digits string) string {
+	invert := func(s string) string {
+		return strings.Map(func(r rune) rune { return '0' + '1' - r }, s)
+	}
+	reverse := func(s string) string {
+		b := []byte(s)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return string(b)
+	}
+
+	modules := "101"
+	for i, c := range digits[1:7] {
+		l := eanLCodes[c-'0']
+		if eanParity[digits[0]-'0'][i] == 'G' {
+			l = reverse(invert(l))
+		}
+		modules += l
+	}
+	modules += "01010"
+	for _, c := range digits[7:] {
+		modules += invert(eanLCodes[c-'0'])
+	}
+	return modules + "101"
+}
+
+// encodeCode128 returns the modules of a Code 128 barcode of text using code set B.
+func encodeCode128(text string) string {
+	values := []int{code128StartB}
+	sum := code128StartB
+	for i, c := range []byte(text) {
+		values = append(values, int(c)-32)
+		sum += (i + 1) * (int(c) - 32)
+	}
+	values = append(values, sum%103)
+
+	var modules strings.Builder
+	draw := func(widths []int) {
+		for i, w := range widths {
+			modules.WriteString(strings.Repeat([]string{"1", "0"}[i%2], w))
+		}
+	}
+	for _, v := range values {
+		draw(code128Patterns[v])
+	}
+	draw(code128Stop)
+	return modules.String()
+}
+
+// renderLinear draws modules scale pixels wide with a 10 module quiet zone either side, optionally turned sideways.
+func renderLinear(modules string, scale int, sideways bool) *image.Gray {
+	w, h := (len(modules)+20)*scale, 60
+	if sideways {
+		w, h = h, w
+	}
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			pos := x
+			if sideways {
+				pos = y
+			}
+			m := pos/scale - 10
+			dark := m >= 0 && m < len(modules) && modules[m] == '1'
+			img.SetGray(x, y, color.Gray{Y: map[bool]uint8{true: 0, false: 255}[dark]})
+		}
+	}
+	return img
+}
+
+func TestScanLinear(t *testing.T) {
+	tests := []struct {
+		name     string
+		modules  string
+		scale    int
+		sideways bool
+		want     Code
+	}{
+		{name: "EAN-13", modules: encodeEAN13("4006381333931"), scale: 3, want: Code{Format: EAN13, Text: "4006381333931"}},
+		{name: "EAN-13 sideways", modules: encodeEAN13("9780201379624"), scale: 2, sideways: true, want: Code{Format: EAN13, Text: "9780201379624"}},
+		{name: "UPC-A", modules: encodeEAN13("0036000291452"), scale: 3, want: Code{Format: UPCA, Text: "036000291452"}},
+		{name: "Code 128", modules: encodeCode128("Hello-123"), scale: 3, want: Code{Format: Code128, Text: "Hello-123"}},
+		{name: "Code 128 sideways", modules: encodeCode128("A17 matinee"), scale: 2, sideways: true, want: Code{Format: Code128, Text: "A17 matinee"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes := ScanImage(renderLinear(tt.modules, tt.scale, tt.sideways))
+			if len(codes) != 1 || codes[0] != tt.want {
+				t.Fatalf("got %+v, want %+v", codes, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanLinearBadCheck(t *testing.T) {
+	// the last digit should be 1
+	if codes := ScanImage(renderLinear(encodeEAN13("4006381333932"), 3, false)); len(codes) != 0 {
+		t.Errorf("got %+v from an EAN-13 with the wrong check digit", codes)
+	}
+
+	modules := encodeCode128("Hello-123")
+	// swap the check symbol, 13 modules before the end, for another
+	var check string
+	for i, w := range code128Patterns[0] {
+		check += strings.Repeat([]string{"1", "0"}[i%2], w)
+	}
+	modules = modules[:len(modules)-24] + check + modules[len(modules)-13:]
+	if codes := ScanImage(renderLinear(modules, 3, false)); len(codes) != 0 {
+		t.Errorf("got %+v from a Code 128 with the wrong check symbol", codes)
+	}
+}
@@ -0,0 +1,237 @@
+package barcode
+
+import (
+	"math"
+	"slices"
+)
+
+// finderPattern is a candidate for one of the three squares in the corners of a QR code, centered on x and y.
+type finderPattern struct {
+	x, y   float64
+	module float64
+	// count is how many rows it was found on, since real ones are found on several.
+	count int
+}
+
+// runs returns the lengths of alternating light and dark runs of pixels along a line, starting with light.
+func runs(line func(i int) bool, length int) []int {
+	lengths := []int{0}
+	dark := false
+	for i := range length {
+		if line(i) != dark {
+			dark = !dark
+			lengths = append(lengths, 0)
+		}
+		lengths[len(lengths)-1]++
+	}
+	return lengths
+}
+
+// finderRatio reports whether 5 run lengths are close to the 1:1:3:1:1 of a finder pattern, returning it's module size.
+func finderRatio(counts []int) (float64, bool) {
+	total := 0
+	for _, c := range counts {
+		if c == 0 {
+			return 0, false
+		}
+		total += c
+	}
+	if total < 7 {
+		return 0, false
+	}
+	module := float64(total) / 7
+	variance := module / 2
+	for i, c := range counts {
+		expected := module
+		if i == 2 {
+			expected *= 3
+		}
+		if math.Abs(float64(c)-expected) >= variance*expected/module {
+			return 0, false
+		}
+	}
+	return module, true
+}
+
+// crossCheck counts the runs of a finder pattern outward from the dark center at pos along a line, returning the center of it's middle run.
+func crossCheck(line func(i int) bool, length, pos int, maxRun int) (float64, float64, bool) {
+	if pos < 0 || pos >= length || !line(pos) {
+		return 0, 0, false
+	}
+	var counts [5]int
+	i := pos
+	// the center's upper or left half, then the light and dark rings before it
+	for ; i >= 0 && line(i); i-- {
+		counts[2]++
+	}
+	for ; i >= 0 && !line(i) && counts[1] <= maxRun; i-- {
+		counts[1]++
+	}
+	for ; i >= 0 && line(i) && counts[0] <= maxRun; i-- {
+		counts[0]++
+	}
+	i = pos + 1
+	for ; i < length && line(i); i++ {
+		counts[2]++
+	}
+	for ; i < length && !line(i) && counts[3] <= maxRun; i++ {
+		counts[3]++
+	}
+	for ; i < length && line(i) && counts[4] <= maxRun; i++ {
+		counts[4]++
+	}
+	module, ok := finderRatio(counts[:])
+	if !ok {
+		return 0, 0, false
+	}
+	end := i - counts[4] - counts[3]
+	return float64(end) - float64(counts[2])/2, module, true
+}
+
+// findFinderPatterns scans every row for the 1:1:3:1:1 dark and light runs through the middle of a finder pattern, confirming each vertically and horizontally.
+func findFinderPatterns(bm *bitmap) []finderPattern {
+	var found []finderPattern
+	for y := range bm.h {
+		row := func(x int) bool { return bm.at(x, y) }
+		lengths := runs(row, bm.w)
+		x := 0
+		for i, l := range lengths {
+			// i is odd for dark runs, and the pattern starts and ends dark
+			if i%2 == 1 && i+5 <= len(lengths) {
+				if module, ok := finderRatio(lengths[i : i+5]); ok {
+					centerX := x + lengths[i] + lengths[i+1] + lengths[i+2]/2
+					if p, ok := confirmFinder(bm, centerX, y, module); ok {
+						found = addFinder(found, p)
+					}
+				}
+			}
+			x += l
+		}
+	}
+	return found
+}
+
+// confirmFinder checks a finder pattern found along a row vertically through it's center, then horizontally again through the refined center.
+func confirmFinder(bm *bitmap, x, y int, module float64) (finderPattern, bool) {
+	maxRun := int(module*4) + 1
+	col := func(i int) bool { return bm.at(x, i) }
+	cy, vModule, ok := crossCheck(col, bm.h, y, maxRun)
+	if !ok || math.Abs(vModule-module) > module/2 {
+		return finderPattern{}, false
+	}
+	row := func(i int) bool { return bm.at(i, int(cy)) }
+	cx, hModule, ok := crossCheck(row, bm.w, x, maxRun)
+	if !ok || math.Abs(hModule-module) > module/2 {
+		return finderPattern{}, false
+	}
+	return finderPattern{x: cx, y: cy, module: (vModule + hModule) / 2, count: 1}, true
+}
+
+// addFinder merges p into a pattern already found at about the same spot, or appends it.
+func addFinder(found []finderPattern, p finderPattern) []finderPattern {
+	for i, f := range found {
+		if math.Abs(f.x-p.x) <= f.module && math.Abs(f.y-p.y) <= f.module && math.Abs(f.module-p.module) <= f.module/2 {
+			n := float64(f.count)
+			found[i] = finderPattern{
+				x:      (f.x*n + p.x) / (n + 1),
+				y:      (f.y*n + p.y) / (n + 1),
+				module: (f.module*n + p.module) / (n + 1),
+				count:  f.count + 1,
+			}
+			return found
+		}
+	}
+	return append(found, p)
+}
+
+// maxFinderCandidates limits the finder patterns tried together, since every combination of 3 is.
+const maxFinderCandidates = 12
+
+// scanQR finds the QR codes within bm from every set of 3 finder patterns that could be the corners of one.
+func scanQR(bm *bitmap) []Code {
+	found := findFinderPatterns(bm)
+	slices.SortFunc(found, func(a, b finderPattern) int { return b.count - a.count })
+	found = found[:min(len(found), maxFinderCandidates)]
+
+	var codes []Code
+	used := make([]bool, len(found))
+	for i := range found {
+		for j := i + 1; j < len(found); j++ {
+			for k := j + 1; k < len(found); k++ {
+				if used[i] || used[j] || used[k] {
+					continue
+				}
+				if text, ok := decodeQRAt(bm, found[i], found[j], found[k]); ok {
+					codes = append(codes, Code{Format: QR, Text: text})
+					used[i], used[j], used[k] = true, true, true
+				}
+			}
+		}
+	}
+	return codes
+}
+
+// decodeQRAt tries decoding a QR code with finder patterns a, b and c in it's corners.
+func decodeQRAt(bm *bitmap, a, b, c finderPattern) (string, bool) {
+	module := (a.module + b.module + c.module) / 3
+	for _, p := range []finderPattern{a, b, c} {
+		if math.Abs(p.module-module) > module/2 {
+			return "", false
+		}
+	}
+
+	// the top left corner is opposite the longest side
+	dist := func(p, q finderPattern) float64 { return math.Hypot(p.x-q.x, p.y-q.y) }
+	ab, bc, ac := dist(a, b), dist(b, c), dist(a, c)
+	var tl, tr, bl finderPattern
+	switch {
+	case bc >= ab && bc >= ac:
+		tl, tr, bl = a, b, c
+	case ac >= ab && ac >= bc:
+		tl, tr, bl = b, a, c
+	default:
+		tl, tr, bl = c, a, b
+	}
+	// with y pointing down, the top right is clockwise from the bottom left
+	if (tr.x-tl.x)*(bl.y-tl.y)-(tr.y-tl.y)*(bl.x-tl.x) < 0 {
+		tr, bl = bl, tr
+	}
+	top, left := dist(tl, tr), dist(tl, bl)
+	if top < module*10 || math.Max(top, left)/math.Min(top, left) > 1.4 {
+		return "", false
+	}
+	// the sides should be about perpendicular
+	if diag := dist(tr, bl); math.Abs(diag*diag-top*top-left*left) > (top*top+left*left)/4 {
+		return "", false
+	}
+
+	// finder pattern centers are 7 modules apart less than the code's size, which is 17 more than a multiple of 4
+	estimate := int(math.Round((top+left)/2/module)) + 7
+	version := int(math.Round(float64(estimate-17) / 4))
+	for _, v := range []int{version, version - 1, version + 1} {
+		if v < 1 || v > 40 {
+			continue
+		}
+		if text, err := decodeQRMatrix(sampleQR(bm, tl, tr, bl, qrSize(v))); err == nil {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// sampleQR reads the module grid of a QR code of size by mapping module centers onto the image relative to it's finder patterns.
+// That's an affine transform, so it can't follow the perspective of a photo taken at an angle.
+func sampleQR(bm *bitmap, tl, tr, bl finderPattern, size int) qrMatrix {
+	m := qrMatrix{size: size, dark: make([]bool, size*size)}
+	span := float64(size - 7)
+	for my := range size {
+		fy := (float64(my) + 0.5 - 3.5) / span
+		for mx := range size {
+			fx := (float64(mx) + 0.5 - 3.5) / span
+			x := tl.x + fx*(tr.x-tl.x) + fy*(bl.x-tl.x)
+			y := tl.y + fx*(tr.y-tl.y) + fy*(bl.y-tl.y)
+			m.dark[my*size+mx] = bm.at(int(x), int(y))
+		}
+	}
+	return m
+}
@@ -0,0 +1,349 @@
+package barcode
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// qrSegment is a run of text encoded in one mode.
+type qrSegment struct {
+	mode int
+	text string
+}
+
+// bitWriter appends bits most significant first.
+type bitWriter struct {
+	bits []bool
+}
+
+func (w *bitWriter) write(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, v>>i&1 == 1)
+	}
+}
+
+// qrData encodes segments into the data codewords of a QR code of version and level, padded as ISO/IEC 18004 says.
+func qrData(t *testing.T, segments []qrSegment, version, level int) []byte {
+	t.Helper()
+	sizeClass := 0
+	if version >= 27 {
+		sizeClass = 2
+	} else if version >= 10 {
+		sizeClass = 1
+	}
+
+	w := &bitWriter{}
+	for _, s := range segments {
+		w.write(s.mode, 4)
+		w.write(len(s.text), qrCountBits[s.mode][sizeClass])
+		switch s.mode {
+		case qrModeNumeric:
+			for i := 0; i < len(s.text); i += 3 {
+				chunk := s.text[i:min(i+3, len(s.text))]
+				v := 0
+				for _, c := range chunk {
+					v = v*10 + int(c-'0')
+				}
+				w.write(v, [4]int{0, 4, 7, 10}[len(chunk)])
+			}
+		case qrModeAlphanumeric:
+			index := func(c byte) int {
+				for i := range len(qrAlphanumeric) {
+					if qrAlphanumeric[i] == c {
+						return i
+					}
+				}
+				t.Fatalf("%q isn't alphanumeric", c)
+				return 0
+			}
+			for i := 0; i < len(s.text); i += 2 {
+				if i+1 == len(s.text) {
+					w.write(index(s.text[i]), 6)
+				} else {
+					w.write(index(s.text[i])*45+index(s.text[i+1]), 11)
+				}
+			}
+		case qrModeByte:
+			for i := range len(s.text) {
+				w.write(int(s.text[i]), 8)
+			}
+		}
+	}
+
+	b := qrBlockTable[version-1][level]
+	capacity := (b.count1*b.data1 + b.count2*(b.data1+1)) * 8
+	if len(w.bits) > capacity {
+		t.Fatalf("%d bits don't fit in version %d level %d", len(w.bits), version, level)
+	}
+	w.write(qrModeTerminator, min(4, capacity-len(w.bits)))
+	for len(w.bits)%8 != 0 {
+		w.bits = append(w.bits, false)
+	}
+	for pad := 0; len(w.bits) < capacity; pad++ {
+		w.write([]int{0xec, 0x11}[pad%2], 8)
+	}
+
+	data := make([]byte, capacity/8)
+	for i, bit := range w.bits {
+		if bit {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return data
+}
+
+// rsEncode returns the ecLen Reed-Solomon error correction codewords for data, with the generator's roots being 2^0 to 2^(ecLen-1).
+func rsEncode(data []byte, ecLen int) []byte {
+	// the generator polynomial's coefficients, from the highest degree
+	gen := []byte{1}
+	for i := range ecLen {
+		next := make([]byte, len(gen)+1)
+		for j, g := range gen {
+			next[j] ^= g
+			next[j+1] ^= gfMul(g, gfPow(i))
+		}
+		gen = next
+	}
+	rem := make([]byte, ecLen)
+	for _, d := range data {
+		factor := d ^ rem[0]
+		copy(rem, rem[1:])
+		rem[ecLen-1] = 0
+		for j := range rem {
+			rem[j] ^= gfMul(gen[j+1], factor)
+		}
+	}
+	return rem
+}
+
+// qrCodewords splits data into blocks, adds their error correction and interleaves them.
+func qrCodewords(data []byte, b qrBlocks) (codewords []byte, blockOffsets [][]int) {
+	var blocks, ecs [][]byte
+	for i := range b.count1 + b.count2 {
+		n := b.data1
+		if i >= b.count1 {
+			n++
+		}
+		blocks, ecs = append(blocks, data[:n]), append(ecs, rsEncode(data[:n], b.ecLen))
+		data = data[n:]
+	}
+	// blockOffsets holds where each block's codewords ended up, so tests can corrupt a particular block
+	blockOffsets = make([][]int, len(blocks))
+	for i := range b.data1 + 1 {
+		for blk, block := range blocks {
+			if i < len(block) {
+				blockOffsets[blk] = append(blockOffsets[blk], len(codewords))
+				codewords = append(codewords, block[i])
+			}
+		}
+	}
+	for i := range b.ecLen {
+		for blk, ec := range ecs {
+			blockOffsets[blk] = append(blockOffsets[blk], len(codewords))
+			codewords = append(codewords, ec[i])
+		}
+	}
+	return codewords, blockOffsets
+}
+
+// qrLevelBits is the inverse of qrECBitsToLevel.
+func qrLevelBits(level int) int {
+	for bits, l := range qrECBitsToLevel {
+		if l == level {
+			return bits
+		}
+	}
+	panic("unknown level")
+}
+
+// encodeQR draws a QR code's modules, placing codewords the way decodeQRMatrix reads them.
+func encodeQR(version, level, mask int, codewords []byte) qrMatrix {
+	size := qrSize(version)
+	m := qrMatrix{size: size, dark: make([]bool, size*size)}
+	set := func(x, y int, dark bool) { m.dark[y*size+x] = dark }
+
+	for _, corner := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+		for dy := range 7 {
+			for dx := range 7 {
+				ring := max(abs(dx-3), abs(dy-3))
+				set(corner[0]+dx, corner[1]+dy, ring != 2)
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		set(i, 6, i%2 == 0)
+		set(6, i, i%2 == 0)
+	}
+	align := qrAlignmentPositions(version)
+	for i, cy := range align {
+		for j, cx := range align {
+			if i == 0 && j == 0 || i == 0 && j == len(align)-1 || i == len(align)-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	format := qrFormatBits(qrLevelBits(level), mask)
+	bit := func(v, i int) bool { return v>>i&1 == 1 }
+	for i := range 6 {
+		set(8, i, bit(format, i))
+	}
+	set(8, 7, bit(format, 6))
+	set(8, 8, bit(format, 7))
+	set(7, 8, bit(format, 8))
+	for i := 9; i < 15; i++ {
+		set(14-i, 8, bit(format, i))
+	}
+	for i := range 8 {
+		set(size-1-i, 8, bit(format, i))
+	}
+	for i := 8; i < 15; i++ {
+		set(8, size-15+i, bit(format, i))
+	}
+	set(8, size-8, true)
+
+	if version >= 7 {
+		rem := version
+		for range 12 {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		info := version<<12 | rem
+		for i := range 18 {
+			set(size-11+i%3, i/3, bit(info, i))
+			set(i/3, size-11+i%3, bit(info, i))
+		}
+	}
+
+	fn := functionModules(version)
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := range size {
+			y := vert
+			if upward {
+				y = size - 1 - vert
+			}
+			for j := range 2 {
+				x := right - j
+				if fn[y*size+x] {
+					continue
+				}
+				// the remainder bits after the last codeword are 0
+				dark := i < len(codewords)*8 && codewords[i/8]&(0x80>>(i%8)) != 0
+				set(x, y, dark != qrMasks[mask](x, y))
+				i++
+			}
+		}
+	}
+	return m
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// renderQR draws m scale pixels per module with a 4 module quiet zone, turned clockwise a quarter turn at a time.
+func renderQR(m qrMatrix, scale, turns int) *image.Gray {
+	side := (m.size + 8) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for y := range side {
+		for x := range side {
+			mx, my := x/scale-4, y/scale-4
+			for range turns {
+				mx, my = my, m.size-1-mx
+			}
+			dark := mx >= 0 && my >= 0 && mx < m.size && my < m.size && m.at(mx, my)
+			img.SetGray(x, y, color.Gray{Y: map[bool]uint8{true: 0, false: 255}[dark]})
+		}
+	}
+	return img
+}
+
+func TestScanQR(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		level    int
+		mask     int
+		segments []qrSegment
+		// corrupt is how many codewords of each block are flipped
+		corrupt int
+		turns   int
+		want    string
+	}{
+		{name: "version 1 L", version: 1, level: ecL, mask: 0, segments: []qrSegment{{qrModeByte, "hello"}}, want: "hello"},
+		{name: "version 1 H numeric", version: 1, level: ecH, mask: 3, segments: []qrSegment{{qrModeNumeric, "0123456789"}}, want: "0123456789"},
+		{name: "version 2 M alphanumeric", version: 2, level: ecM, mask: 5, segments: []qrSegment{{qrModeAlphanumeric, "HTTPS://EXAMPLE.COM/A17"}}, want: "HTTPS://EXAMPLE.COM/A17"},
+		{name: "version 3 Q mixed modes", version: 3, level: ecQ, mask: 2, segments: []qrSegment{{qrModeByte, "ticket "}, {qrModeNumeric, "20240601"}}, want: "ticket 20240601"},
+		{name: "version 5 H uneven blocks", version: 5, level: ecH, mask: 7, segments: []qrSegment{{qrModeByte, "https://example.com/tickets/A17"}}, want: "https://example.com/tickets/A17"},
+		{name: "version 7 M with version information", version: 7, level: ecM, mask: 4, segments: []qrSegment{{qrModeByte, "The quick brown fox jumps over the lazy dog, twice over: the quick brown fox"}}, want: "The quick brown fox jumps over the lazy dog, twice over: the quick brown fox"},
+		{name: "version 10 L with 16 bit counts", version: 10, level: ecL, mask: 6, segments: []qrSegment{{qrModeByte, "searmage indexes the text within images using Tesseract OCR"}}, want: "searmage indexes the text within images using Tesseract OCR"},
+		{name: "UTF-8", version: 2, level: ecL, mask: 1, segments: []qrSegment{{qrModeByte, "café ☕"}}, want: "café ☕"},
+		{name: "upside down", version: 2, level: ecM, mask: 0, segments: []qrSegment{{qrModeByte, "rotated"}}, turns: 2, want: "rotated"},
+		{name: "sideways", version: 4, level: ecQ, mask: 1, segments: []qrSegment{{qrModeByte, "rotated"}}, turns: 1, want: "rotated"},
+		// M level blocks have 16 or 18 error correction codewords, so up to 8 or 9 wrong ones per block are fixable
+		{name: "version 2 M corrupted", version: 2, level: ecM, mask: 2, segments: []qrSegment{{qrModeByte, "reed solomon"}}, corrupt: 7, want: "reed solomon"},
+		{name: "version 6 Q corrupted in every block", version: 6, level: ecQ, mask: 3, segments: []qrSegment{{qrModeByte, "every block"}}, corrupt: 10, want: "every block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := qrBlockTable[tt.version-1][tt.level]
+			codewords, offsets := qrCodewords(qrData(t, tt.segments, tt.version, tt.level), b)
+			for _, blk := range offsets {
+				for i := range tt.corrupt {
+					// spread the errors over the data and error correction codewords
+					codewords[blk[i*len(blk)/tt.corrupt]] ^= 0x5a
+				}
+			}
+			img := renderQR(encodeQR(tt.version, tt.level, tt.mask, codewords), 4, tt.turns)
+
+			codes := ScanImage(img)
+			if len(codes) != 1 || codes[0] != (Code{Format: QR, Text: tt.want}) {
+				t.Fatalf("got %+v, want %q", codes, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanQRTooCorrupted(t *testing.T) {
+	b := qrBlockTable[1][ecL]
+	codewords, offsets := qrCodewords(qrData(t, []qrSegment{{qrModeByte, "too far gone"}}, 2, ecL), b)
+	// 10 error correction codewords fix 5 wrong ones at most
+	for i := range 8 {
+		codewords[offsets[0][i*3]] ^= 0xff
+	}
+	if codes := ScanImage(renderQR(encodeQR(2, ecL, 0, codewords), 4, 0)); len(codes) != 0 {
+		t.Fatalf("got %+v from a QR code with more errors than it can correct", codes)
+	}
+}
+
+func TestRSCorrect(t *testing.T) {
+	data := []byte("an arbitrary block of data codewords")
+	const ecLen = 10
+	clean := append(append([]byte{}, data...), rsEncode(data, ecLen)...)
+
+	for errs := range ecLen/2 + 1 {
+		block := append([]byte{}, clean...)
+		for i := range errs {
+			block[i*len(block)/max(1, errs)] ^= byte(i + 1)
+		}
+		if err := rsCorrect(block, ecLen); err != nil {
+			t.Fatalf("%d errors: %v", errs, err)
+		}
+		if string(block) != string(clean) {
+			t.Fatalf("%d errors weren't corrected: %x", errs, block)
+		}
+	}
+}
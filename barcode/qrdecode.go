@@ -0,0 +1,369 @@
+package barcode
+
+import (
+	"math/bits"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// qrMatrix is a QR code's modules, with dark ones set.
+type qrMatrix struct {
+	size int
+	dark []bool
+}
+
+func (m qrMatrix) at(x, y int) bool {
+	return m.dark[y*m.size+x]
+}
+
+// qrECBitsToLevel maps the error correction level within format information to qrBlockTable's columns.
+var qrECBitsToLevel = [4]int{ecM, ecL, ecH, ecQ}
+
+// qrFormatBits returns the 15 bits of format information for the error correction level's bits and mask, error corrected with a BCH code.
+func qrFormatBits(ecBits, mask int) int {
+	data := ecBits<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// qrMasks report whether the module at column x and row y is flipped by each mask.
+var qrMasks = [8]func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(x, y int) bool { return y%2 == 0 },
+	func(x, y int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+// readFormat reads the error correction level and mask from either copy of the format information, whichever is readable.
+func (m qrMatrix) readFormat() (level, mask int, err error) {
+	var first, second int
+	bit := func(x, y int) int {
+		if m.at(x, y) {
+			return 1
+		}
+		return 0
+	}
+	for i := range 6 {
+		first |= bit(8, i) << i
+	}
+	first |= bit(8, 7)<<6 | bit(8, 8)<<7 | bit(7, 8)<<8
+	for i := 9; i < 15; i++ {
+		first |= bit(14-i, 8) << i
+	}
+	for i := range 8 {
+		second |= bit(m.size-1-i, 8) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= bit(8, m.size-15+i) << i
+	}
+
+	best := 4
+	for ecBits := range 4 {
+		for mk := range 8 {
+			want := qrFormatBits(ecBits, mk)
+			// the BCH code corrects up to 3 wrong bits
+			if d := min(bits.OnesCount(uint(first^want)), bits.OnesCount(uint(second^want))); d < best {
+				best, level, mask = d, qrECBitsToLevel[ecBits], mk
+			}
+		}
+	}
+	if best > 3 {
+		return 0, 0, errors.New("unreadable format information")
+	}
+	return level, mask, nil
+}
+
+// functionModules marks the modules of a QR code of version that hold it's finder, timing and alignment patterns or format and version information, rather than data.
+func functionModules(version int) []bool {
+	size := qrSize(version)
+	fn := make([]bool, size*size)
+	fill := func(x0, y0, w, h int) {
+		for y := max(0, y0); y < min(size, y0+h); y++ {
+			for x := max(0, x0); x < min(size, x0+w); x++ {
+				fn[y*size+x] = true
+			}
+		}
+	}
+	// finder patterns with their separators and the format information beside them
+	fill(0, 0, 9, 9)
+	fill(size-8, 0, 8, 9)
+	fill(0, size-8, 9, 8)
+	// timing patterns
+	fill(6, 0, 1, size)
+	fill(0, 6, size, 1)
+
+	align := qrAlignmentPositions(version)
+	for i, y := range align {
+		for j, x := range align {
+			// alignment patterns that would overlap a finder pattern are left out
+			if i == 0 && j == 0 || i == 0 && j == len(align)-1 || i == len(align)-1 && j == 0 {
+				continue
+			}
+			fill(x-2, y-2, 5, 5)
+		}
+	}
+	if version >= 7 {
+		fill(size-11, 0, 3, 6)
+		fill(0, size-11, 6, 3)
+	}
+	return fn
+}
+
+// decodeQRMatrix decodes the text within a QR code.
+func decodeQRMatrix(m qrMatrix) (string, error) {
+	version := (m.size - 17) / 4
+	if version < 1 || version > 40 || qrSize(version) != m.size {
+		return "", errors.Errorf("invalid QR code size %d", m.size)
+	}
+	level, mask, err := m.readFormat()
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+
+	// codewords are placed in 2 module wide columns zigzagging up and down from the bottom right, skipping the vertical timing pattern
+	fn := functionModules(version)
+	raw := make([]byte, qrRawCodewords(version))
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := range m.size {
+			y := vert
+			if upward {
+				y = m.size - 1 - vert
+			}
+			for j := range 2 {
+				x := right - j
+				if fn[y*m.size+x] || i >= len(raw)*8 {
+					continue
+				}
+				if m.at(x, y) != qrMasks[mask](x, y) {
+					raw[i/8] |= 0x80 >> (i % 8)
+				}
+				i++
+			}
+		}
+	}
+
+	data, err := qrCorrect(raw, qrBlockTable[version-1][level])
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	text, err := qrParseSegments(data, version)
+	return text, errors.Wrap(err)
+}
+
+// qrCorrect splits the interleaved codewords into their blocks, corrects each, and returns the data codewords in order.
+func qrCorrect(raw []byte, b qrBlocks) ([]byte, error) {
+	count := b.count1 + b.count2
+	blocks := make([][]byte, count)
+	dataLens := make([]int, count)
+	for i := range blocks {
+		dataLens[i] = b.data1
+		if i >= b.count1 {
+			dataLens[i]++
+		}
+		blocks[i] = make([]byte, 0, dataLens[i]+b.ecLen)
+	}
+	// data codewords are interleaved a codeword from each block at a time, then the error correction codewords
+	pos := 0
+	for i := range b.data1 + 1 {
+		for blk := range blocks {
+			if i < dataLens[blk] {
+				blocks[blk] = append(blocks[blk], raw[pos])
+				pos++
+			}
+		}
+	}
+	for range b.ecLen {
+		for blk := range blocks {
+			blocks[blk] = append(blocks[blk], raw[pos])
+			pos++
+		}
+	}
+
+	var data []byte
+	for blk, block := range blocks {
+		if err := rsCorrect(block, b.ecLen); err != nil {
+			return nil, errors.Wrapf(err, "block %d", blk)
+		}
+		data = append(data, block[:dataLens[blk]]...)
+	}
+	return data, nil
+}
+
+// bitReader reads big endian bit fields.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) read(n int) (int, error) {
+	if n > r.remaining() {
+		return 0, errors.New("QR code data ended early")
+	}
+	v := 0
+	for range n {
+		v = v<<1 | int(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v, nil
+}
+
+// QR code segment modes, https://www.thonky.com/qr-code-tutorial/data-encoding
+const (
+	qrModeTerminator   = 0
+	qrModeNumeric      = 1
+	qrModeAlphanumeric = 2
+	qrModeStructured   = 3
+	qrModeByte         = 4
+	qrModeFNC1First    = 5
+	qrModeECI          = 7
+	qrModeKanji        = 8
+	qrModeFNC1Second   = 9
+)
+
+const qrAlphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// qrCountBits is the width of a segment's character count for numeric, alphanumeric, byte and kanji modes, for versions up to 9, 26 and 40.
+var qrCountBits = map[int][3]int{
+	qrModeNumeric:      {10, 12, 14},
+	qrModeAlphanumeric: {9, 11, 13},
+	qrModeByte:         {8, 16, 16},
+	qrModeKanji:        {8, 10, 12},
+}
+
+// qrParseSegments decodes the segments within a QR code's data codewords into text.
+// Byte segments are usually UTF-8, and are read as ISO 8859-1 otherwise. Kanji isn't supported, so it's replaced with U+FFFD.
+func qrParseSegments(data []byte, version int) (string, error) {
+	r := &bitReader{data: data}
+	sizeClass := 0
+	if version >= 27 {
+		sizeClass = 2
+	} else if version >= 10 {
+		sizeClass = 1
+	}
+
+	var text strings.Builder
+	var bytes []byte
+	for r.remaining() >= 4 {
+		mode, _ := r.read(4)
+		if mode == qrModeTerminator {
+			break
+		}
+		switch mode {
+		case qrModeFNC1First:
+			continue
+		case qrModeFNC1Second:
+			if _, err := r.read(8); err != nil {
+				return "", errors.Wrap(err)
+			}
+			continue
+		case qrModeStructured:
+			// the position within a sequence of codes and their parity
+			if _, err := r.read(16); err != nil {
+				return "", errors.Wrap(err)
+			}
+			continue
+		case qrModeECI:
+			// the designator is 1 to 3 bytes long, and we assume it's UTF-8 regardless
+			first, err := r.read(8)
+			if err != nil {
+				return "", errors.Wrap(err)
+			}
+			extra := 0
+			if first&0xc0 == 0x80 {
+				extra = 1
+			} else if first&0xe0 == 0xc0 {
+				extra = 2
+			}
+			if _, err = r.read(extra * 8); err != nil {
+				return "", errors.Wrap(err)
+			}
+			continue
+		}
+
+		countBits, ok := qrCountBits[mode]
+		if !ok {
+			return "", errors.Errorf("unknown QR code mode %d", mode)
+		}
+		count, err := r.read(countBits[sizeClass])
+		if err != nil {
+			return "", errors.Wrap(err)
+		}
+		switch mode {
+		case qrModeNumeric:
+			for ; count > 0; count -= 3 {
+				digits := min(count, 3)
+				v, err := r.read([4]int{0, 4, 7, 10}[digits])
+				if err != nil {
+					return "", errors.Wrap(err)
+				}
+				bytes = append(bytes, []byte(zeroPad(v, digits))...)
+			}
+		case qrModeAlphanumeric:
+			for ; count > 0; count -= 2 {
+				if count == 1 {
+					v, err := r.read(6)
+					if err != nil || v >= 45 {
+						return "", errors.Errorf("invalid alphanumeric character")
+					}
+					bytes = append(bytes, qrAlphanumeric[v])
+					break
+				}
+				v, err := r.read(11)
+				if err != nil || v >= 45*45 {
+					return "", errors.Errorf("invalid alphanumeric characters")
+				}
+				bytes = append(bytes, qrAlphanumeric[v/45], qrAlphanumeric[v%45])
+			}
+		case qrModeByte:
+			for range count {
+				v, err := r.read(8)
+				if err != nil {
+					return "", errors.Wrap(err)
+				}
+				bytes = append(bytes, byte(v))
+			}
+		case qrModeKanji:
+			if _, err = r.read(13 * count); err != nil {
+				return "", errors.Wrap(err)
+			}
+			bytes = append(bytes, []byte(strings.Repeat(string(utf8.RuneError), count))...)
+		}
+	}
+
+	if utf8.Valid(bytes) {
+		text.Write(bytes)
+	} else {
+		for _, b := range bytes {
+			text.WriteRune(rune(b))
+		}
+	}
+	return text.String(), nil
+}
+
+// zeroPad formats v with at least digits digits.
+func zeroPad(v, digits int) string {
+	s := []byte("000")
+	for i := digits - 1; i >= 0; i-- {
+		s[i] = byte('0' + v%10)
+		v /= 10
+	}
+	return string(s[:digits])
+}
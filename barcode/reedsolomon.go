@@ -0,0 +1,141 @@
+package barcode
+
+import "github.com/danlock/pkg/errors"
+
+// gfExp and gfLog are powers and logarithms of 2 within GF(256) as QR codes define it, with the primitive polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := range 255 {
+		exp[i], log[x] = byte(x), byte(i)
+		if x <<= 1; x >= 256 {
+			x ^= 0x11d
+		}
+	}
+	// doubling the table saves reducing exponents mod 255 when multiplying
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfScale returns p with every coefficient multiplied by c.
+func gfScale(p []byte, c byte) []byte {
+	scaled := make([]byte, len(p))
+	for i, v := range p {
+		scaled[i] = gfMul(v, c)
+	}
+	return scaled
+}
+
+// gfPow returns 2 to the power of e.
+func gfPow(e int) byte {
+	return gfExp[((e%255)+255)%255]
+}
+
+// rsCorrect fixes up to ecLen/2 wrong codewords in block, whose last ecLen codewords are Reed-Solomon error correction, in place.
+// https://en.wikiversity.org/wiki/Reed%E2%80%93Solomon_codes_for_coders
+func rsCorrect(block []byte, ecLen int) error {
+	n := len(block)
+	// syndromes are the block evaluated at each root of the generator polynomial, all 0 if nothing's wrong
+	syndromes := make([]byte, ecLen)
+	clean := true
+	for i := range syndromes {
+		var s byte
+		for _, c := range block {
+			s = gfMul(s, gfPow(i)) ^ c
+		}
+		syndromes[i] = s
+		clean = clean && s == 0
+	}
+	if clean {
+		return nil
+	}
+
+	// Berlekamp-Massey finds the error locator polynomial, with coefficients from the lowest degree
+	locator, prev := []byte{1}, []byte{1}
+	for i := range ecLen {
+		prev = append([]byte{0}, prev...)
+		delta := syndromes[i]
+		for j := 1; j < len(locator) && j <= i; j++ {
+			delta ^= gfMul(locator[j], syndromes[i-j])
+		}
+		if delta == 0 {
+			continue
+		}
+		if len(prev) > len(locator) {
+			next := gfScale(prev, delta)
+			prev = gfScale(locator, gfDiv(1, delta))
+			locator = next
+		}
+		for j, p := range prev {
+			if j >= len(locator) {
+				locator = append(locator, 0)
+			}
+			locator[j] ^= gfMul(p, delta)
+		}
+	}
+	for len(locator) > 1 && locator[len(locator)-1] == 0 {
+		locator = locator[:len(locator)-1]
+	}
+	errCount := len(locator) - 1
+	if errCount*2 > ecLen {
+		return errors.New("too many errors to correct")
+	}
+
+	// the roots of the locator are the inverses of 2^position for each wrong codeword, counting positions from the end of the block
+	var positions []int
+	for pos := range n {
+		var v byte
+		inv := gfPow(-pos)
+		for j := len(locator) - 1; j >= 0; j-- {
+			v = gfMul(v, inv) ^ locator[j]
+		}
+		if v == 0 {
+			positions = append(positions, pos)
+		}
+	}
+	if len(positions) != errCount {
+		return errors.New("failed locating errors")
+	}
+
+	// Forney's algorithm finds each error's value from the evaluator polynomial, the syndromes times the locator mod x^ecLen
+	evaluator := make([]byte, ecLen)
+	for i := range ecLen {
+		for j := 0; j <= i && j < len(locator); j++ {
+			evaluator[i] ^= gfMul(syndromes[i-j], locator[j])
+		}
+	}
+	for _, pos := range positions {
+		xInv := gfPow(-pos)
+		var num, denom byte
+		for i := len(evaluator) - 1; i >= 0; i-- {
+			num = gfMul(num, xInv) ^ evaluator[i]
+		}
+		// the formal derivative of the locator keeps only it's odd terms
+		for j := len(locator) - 1; j >= 1; j-- {
+			if j%2 == 1 {
+				denom ^= gfMul(locator[j], gfPow(-pos*(j-1)))
+			}
+		}
+		if denom == 0 {
+			return errors.New("failed correcting errors")
+		}
+		// with the generator's first root being 2^0, the error is X times Ω(X^-1) / Λ'(X^-1)
+		block[n-1-pos] ^= gfMul(gfPow(pos), gfDiv(num, denom))
+	}
+	return nil
+}
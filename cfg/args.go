@@ -3,48 +3,313 @@ package cfg
 import (
 	"database/sql"
 	"flag"
+	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/audit"
+	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/entities"
+	"github.com/danlock/searmage/hashing"
+	"github.com/danlock/searmage/thumbnail"
 )
 
+// Commands are the subcommands searmage accepts as it's first argument, along with their descriptions.
+// Without a command searmage parses the images within -dir, or searches them if -search is set.
+var Commands = map[string]string{
+	"audit":         "Scans the text of indexed images for sensitive data such as card numbers, API keys and private keys, listing the images it's in with the redacted match and where it is within the image. See -detector.",
+	"check":         "Lists the images indexed since the saved searches named after the command, or every saved search if omitted, were last checked that match them. See save-search, -events and -on-match.",
+	"config":        "Given show after it, prints the value of every flag as TOML along with whether it came from a flag, SEARMAGE_* environment variable, the config file or it's default. See -config.",
+	"delete-search": "Deletes the saved search named after the command.",
+	"duplicates":    "Lists images found at more than one path, with their size, wasting the most space first.",
+	"edit":          "Corrects the text of the indexed image at the path given after the command, keeping the parsed text. The text is given after the path, read from stdin if it's -, or edited in $EDITOR if omitted. Edited images aren't parsed again when their file changes unless -overwrite-edits is set.",
+	"export":        "Writes every indexed image as JSON Lines to the file given after the command, or stdout if omitted or -.",
+	"import":        "Reads JSON Lines written by export from the file given after the command, or stdin if omitted or -, upserting images by hash.",
+	"index":         "Parses the images and directories given after the command, along with any -dir or -files-from. Given - instead, parses an image read from stdin and stores it as -name.",
+	"maintain":      "Optimizes and integrity checks the database, then VACUUMs it to reclaim space. Refuses to run while another searmage process is writing.",
+	"note":          "Sets the note of the indexed image at the path given after the command to the text given after it, so searches match it. Notes are kept by hash, so they follow the image when it's renamed.",
+	"prune":         "Removes images whose files no longer exist from the database, along with their thumbnails. Images within a root that isn't mounted are left alone.",
+	"rehash":        "Rehashes indexed images stored with a different -hash from their files, without parsing them again. Copies indexed under different hashes are merged.",
+	"remap-root":    "Moves the root named after the command to the path given after it, e.g. remap-root photos /mnt/nas/photos. Images within it are found there without re-indexing.",
+	"roots":         "Lists the roots stored in the database.",
+	"save-search":   "Saves the search given after the name following the command, e.g. save-search receipts total amount, so check and index find new images matching it. Honours -regex. Saving under an existing name replaces it's search.",
+	"searches":      "Lists the saved searches.",
+	"serve":         "Serves a web UI and a read only JSON API at -addr with the endpoints /search?q=text&mode=match|regex&root=&path_prefix=&format=&camera=&taken_after=&taken_before=&has_location=true&collapse=true&tag=&similar_to={id}&max_distance=10&limit=&offset=&snippets=true, /images/{id}, /images/{id}/file, /images/{id}/thumbnail and /stats. With -allow-edits, PUT and DELETE /images/{id}/text edit an image's text.",
+	"similar":       "Lists groups of images that look alike, such as resized or re-saved copies, by their perceptual hash. Given an image file after the command, lists the indexed images that look like it instead. See -distance.",
+	"tag":           "Adds the tags given after the path of an indexed image, so searches match them and -tag finds it. Tags are kept by hash, so they follow the image when it's renamed.",
+	"unedit":        "Restores the parsed text of the indexed image at the path given after the command, undoing edit.",
+	"unnote":        "Removes the note of the indexed image at the path given after the command.",
+	"untag":         "Removes the tags given after the path of an indexed image.",
+}
+
 type Args struct {
-	ImageDir string
-	Search   string
-	Workers  uint
-	Debug    bool
-	Clear    bool
-	IsRegex  bool
+	Command     string
+	CommandArgs []string
+
+	ImageDirs []string
+	// FilesFrom is a file listing paths to parse, or - for stdin.
+	FilesFrom string
+	// StdinName is what an image read from stdin is stored as.
+	StdinName  string
+	Search     string
+	VacuumInto string
+	Addr       string
+	Workers    uint
+	ThumbSize  int
+	Debug      bool
+	Clear      bool
+	IsRegex    bool
+
+	// Hash is what images are identified by, see hashing.Algorithm.
+	Hash hashing.Algorithm
+	// Barcodes decodes QR codes and barcodes while parsing, see ocr.Options.
+	Barcodes bool
+	// OverwriteEdits parses changed images again even if their text was edited, see ocr.Options.
+	OverwriteEdits bool
+	// AllowEdits lets serve edit text, opening the database for writing.
+	AllowEdits bool
+	// OnIndexed, OnFailed and OnMatch are shell commands run for each image indexed, failing to be indexed, or matching a saved search, see events.Run.
+	OnIndexed string
+	OnFailed  string
+	OnMatch   string
+	// Events is a file events are written to as JSON Lines, or - for stdout.
+	Events string
+
+	// Format, Camera, TakenAfter, TakenBefore and HasLocation filter -search by image metadata, see db.Query.
+	Format      string
+	Camera      string
+	TakenAfter  time.Time
+	TakenBefore time.Time
+	HasLocation bool
+	// Tags limits -search to images with all of them, and may be searched without -search.
+	Tags []string
+	// Collapse returns copies of an image as one -search result.
+	Collapse bool
+	// SimilarTo limits -search to images that look like the image file at this path.
+	SimilarTo string
+	// MaxDistance is how many bits perceptual hashes may differ by for images to be similar.
+	MaxDistance int
+	// ListEntities lists the entities of type Entity, or every type if it's empty, instead of searching. -search narrows which images they're from.
+	ListEntities bool
+	Entity       entities.Type
+
+	// Include and Exclude are globs, see ocr.Walker.
+	Include        []string
+	Exclude        []string
+	SkipHidden     bool
+	FollowSymlinks bool
 
 	DB     *sql.DB
 	DBPath string
+	// Index names a database within DataDir, used if DBPath isn't set.
+	Index string
+	// LegacyDBPath is a database left in the temp directory by an older searmage, set if the default database doesn't exist yet.
+	LegacyDBPath string
 
 	TrainedData     *os.File
 	trainedDataPath string
+
+	RewritePrefixes []PrefixRewrite
+	// Detectors are what audit looks for, every built in audit.Detector if empty.
+	Detectors []audit.Detector
+	// Roots maps a root's name to it's absolute path.
+	Roots map[string]string
+
+	// ConfigPath is the config file settings were loaded from, if any.
+	ConfigPath string
+	// Sources is where each flag's value came from, by it's name.
+	Sources map[string]Source
+	// funcValues are the values of the flags registered with funcFlag, which can't report them like other flags.
+	funcValues map[string][]string
+}
+
+// PrefixRewrite swaps the Old prefix of a path for New.
+type PrefixRewrite struct{ Old, New string }
+
+// RewritePath applies the first of RewritePrefixes that matches p.
+func (a Args) RewritePath(p string) string {
+	for _, r := range a.RewritePrefixes {
+		if rest, ok := strings.CutPrefix(p, r.Old); ok {
+			return r.New + rest
+		}
+	}
+	return p
 }
 
 func ParseFlags() (Args, error) {
-	var a Args
-	flag.UintVar(&a.Workers, "workers", uint(runtime.NumCPU()/3), "Number of workers used for parsing. More workers mean more CPU usage.")
-	flag.StringVar(&a.ImageDir, "dir", "", "Path of an directory containing JPEG or PNG images to parse.")
+	a := Args{MaxDistance: 10, Hash: hashing.Default, funcValues: map[string][]string{}}
+	flag.UintVar(&a.Workers, "workers", uint(max(1, runtime.NumCPU()/3)), "Number of workers used for parsing. More workers mean more CPU usage.")
+	funcFlag(a.funcValues, "dir", "Path of an directory containing JPEG or PNG images to parse. May be repeated.", func(s string) error {
+		a.ImageDirs = append(a.ImageDirs, s)
+		return nil
+	})
+	flag.StringVar(&a.FilesFrom, "files-from", "", "Parses the paths listed in this file, or stdin if -, separated by newlines or NUL characters like the output of find -print0 or git ls-files -z.")
+	flag.StringVar(&a.StdinName, "name", "", "index: The name, usually a path, to store an image read from stdin as.")
+	funcFlag(a.funcValues, "include", "Only parse images matching this glob, such as *.png or screenshots/**. Globs with a slash match the path relative to -dir, otherwise the file name. May be repeated.", globFlag(&a.Include))
+	funcFlag(a.funcValues, "exclude", "Skip files and directories matching this glob, such as node_modules or **/.thumbnails. Globs with a slash match the path relative to -dir, otherwise the name. May be repeated.", globFlag(&a.Exclude))
+	flag.BoolVar(&a.SkipHidden, "skip-hidden", false, "If set, skips files and directories starting with a dot.")
+	flag.BoolVar(&a.FollowSymlinks, "follow-symlinks", false, "If set, follows symlinks to directories, walking each directory only once. Symlinks to images are always indexed.")
 	flag.StringVar(&a.trainedDataPath, "trained-data", "", "English training data is used by default, however other language data can be downloaded here (https://github.com/tesseract-ocr/tessdata_fast)")
-	flag.StringVar(&a.DBPath, "db", path.Join(os.TempDir(), "searmage.sqlite3"), "Path to place the database where searmage indexes image text. Defaults to the temp directory.")
+	flag.StringVar(&a.ConfigPath, "config", "", "A TOML, YAML or JSON file of flag names and their values, such as db = \"/data/searmage.sqlite3\" or dir = [\"~/Pictures\", \"~/Downloads\"]. Defaults to config.toml, .yaml, .yml or .json within $XDG_CONFIG_HOME/searmage/, or searmage.toml and so on beside -db. Each flag may also be set by an environment variable such as SEARMAGE_TRAINED_DATA. Flags override the environment, which overrides the config file.")
+	flag.StringVar(&a.DBPath, "db", "", fmt.Sprintf("Path to place the database where searmage indexes image text. Defaults to the -index within %s.", DataDir()))
+	flag.StringVar(&a.Index, "index", "", fmt.Sprintf("The name of a database within %s to use instead of -db, so separate indexes can be kept for work and home. (default %s)", DataDir(), DefaultIndex))
 	flag.BoolVar(&a.Debug, "debug", false, "Enable debug logging.")
 	flag.BoolVar(&a.Clear, "clear", false, "If set, clears the given database instead of parsing images.")
 	flag.StringVar(&a.Search, "search", "", "If set, searches for the given text within previously parsed images instead of parsing images. (by default uses MATCH from https://www.sqlite.org/fts5.html)")
 	flag.BoolVar(&a.IsRegex, "regex", false, "If set, -search is evaluated as REGEXP instead of MATCH using https://pkg.go.dev/regexp/syntax")
-	flag.Parse()
-	// short circuit if we aren't parsing images
-	if a.Clear || a.Search != "" {
+	flag.StringVar(&a.Format, "format", "", "Limits -search to images of this format, such as jpeg or png.")
+	flag.StringVar(&a.Camera, "camera", "", "Limits -search to photos taken by a camera whose EXIF make or model contains this, such as pixel or canon.")
+	funcFlag(a.funcValues, "taken-after", "Limits -search to photos taken on or after this date (2006-01-02) or time (2006-01-02T15:04:05), according to their EXIF.", takenAtFlag(&a.TakenAfter))
+	funcFlag(a.funcValues, "taken-before", "Limits -search to photos taken before this date (2006-01-02) or time (2006-01-02T15:04:05), according to their EXIF.", takenAtFlag(&a.TakenBefore))
+	flag.BoolVar(&a.HasLocation, "has-location", false, "If set, limits -search to photos with GPS coordinates in their EXIF.")
+	funcFlag(a.funcValues, "tag", "Limits -search to images with this tag, or searches by it if -search isn't set. May be repeated to require several.", func(s string) error {
+		a.Tags = append(a.Tags, s)
+		return nil
+	})
+	flag.BoolVar(&a.Collapse, "collapse", false, "If set, -search returns copies of an image found at several paths once.")
+	flag.StringVar(&a.SimilarTo, "similar-to", "", "Limits -search to images that look like the image file at this path, see -distance.")
+	funcFlag(a.funcValues, "entity", fmt.Sprintf("If set, lists the entities of this type found within parsed images along with the images they're in, instead of parsing images. One of %v or all. -search narrows it to images matching the text.", entities.Types), func(s string) (err error) {
+		a.ListEntities = true
+		if s == "all" {
+			return nil
+		}
+		a.Entity, err = entities.ParseType(s)
+		return err
+	})
+	funcFlag(a.funcValues, "distance", "similar and -similar-to: How many of the 64 bits of their perceptual hashes images may differ by to count as similar. (default 10)", func(s string) (err error) {
+		if a.MaxDistance, err = strconv.Atoi(s); err != nil || a.MaxDistance < 0 || a.MaxDistance > 64 {
+			return errors.New("expected a number from 0 to 64")
+		}
+		return nil
+	})
+	flag.StringVar(&a.VacuumInto, "vacuum-into", "", "maintain: If set, writes a compacted backup of the database to this path with VACUUM INTO instead of VACUUMing in place.")
+	flag.IntVar(&a.ThumbSize, "thumb-size", thumbnail.DefaultSize, "The longest side of the thumbnails generated while parsing, in pixels. 0 disables them.")
+	funcFlag(a.funcValues, "hash", fmt.Sprintf("How images are identified by their content, one of %v. Run rehash after changing it for an existing database, so copies are still recognized. (default %s)", hashing.Algorithms, hashing.Default), func(s string) (err error) {
+		a.Hash, err = hashing.ParseAlgorithm(s)
+		return err
+	})
+	flag.BoolVar(&a.OverwriteEdits, "overwrite-edits", false, "If set, images whose text was corrected with edit are parsed again when their file changes, replacing the correction. Otherwise they're left alone.")
+	flag.BoolVar(&a.AllowEdits, "allow-edits", false, "serve: If set, the API can correct an image's text like the edit command, with PUT and DELETE /images/{id}/text. The database is opened for writing.")
+	flag.BoolVar(&a.Barcodes, "barcodes", false, "If set, QR codes and barcodes are decoded while parsing images so -search finds images by the links or numbers within them. Images parsed before are scanned for them without being OCRed again.")
+	flag.StringVar(&a.OnMatch, "on-match", "", "index and check: A shell command run for each image matching a saved search, given SEARMAGE_EVENT_TYPE, SEARMAGE_EVENT_PATH, SEARMAGE_EVENT_IMAGE_ID, SEARMAGE_EVENT_HASH and SEARMAGE_EVENT_SEARCH environment variables.")
+	flag.StringVar(&a.OnIndexed, "on-indexed", "", "index: A shell command run for each image indexed, given SEARMAGE_EVENT_TYPE, SEARMAGE_EVENT_PATH, SEARMAGE_EVENT_IMAGE_ID and SEARMAGE_EVENT_HASH environment variables and the image's text on stdin.")
+	flag.StringVar(&a.OnFailed, "on-failed", "", "index: A shell command run for each image that couldn't be indexed, given SEARMAGE_EVENT_TYPE, SEARMAGE_EVENT_PATH and SEARMAGE_EVENT_ERROR environment variables.")
+	flag.StringVar(&a.Events, "events", "", "index, prune and check: Appends a JSON line to this file, or writes it to stdout if -, for each image indexed, failed, pruned or matching a saved search.")
+	flag.StringVar(&a.Addr, "addr", "localhost:8080", "serve: The address to listen on.")
+	funcFlag(a.funcValues, "detector", fmt.Sprintf("audit: Looks for this built in detector, or a custom one given as name=regex whose first capture group, if any, is what's redacted. May be repeated. (default %s)", detectorNames()), func(s string) error {
+		d, err := audit.ParseDetector(s)
+		a.Detectors = append(a.Detectors, d)
+		return err
+	})
+	funcFlag(a.funcValues, "rewrite-prefix", "import: Rewrites imported paths beginning with old to begin with new, given as old=new. May be repeated.", func(s string) error {
+		oldPrefix, newPrefix, ok := strings.Cut(s, "=")
+		if !ok || oldPrefix == "" {
+			return errors.Errorf("expected old=new, got %s", s)
+		}
+		a.RewritePrefixes = append(a.RewritePrefixes, PrefixRewrite{Old: oldPrefix, New: newPrefix})
+		return nil
+	})
+	funcFlag(a.funcValues, "root", "Names a directory so images within it are stored relative to it, given as name=path. Lets a database follow images to a different mount point. While parsing images new roots are saved in the database, otherwise this only overrides where a saved root is for this run. May be repeated.", func(s string) error {
+		name, rootPath, ok := strings.Cut(s, "=")
+		if !ok || name == "" || rootPath == "" {
+			return errors.Errorf("expected name=path, got %s", s)
+		}
+		rootPath, err := filepath.Abs(rootPath)
+		if err != nil {
+			return errors.Wrapf(err, "filepath.Abs")
+		}
+		if a.Roots == nil {
+			a.Roots = map[string]string{}
+		}
+		a.Roots[name] = rootPath
+		return nil
+	})
+
+	// flag.Parse stops at the first non flag argument, such as the command or it's arguments. Keep parsing after each so flags may go anywhere.
+	positional, rest := []string{}, os.Args[1:]
+	for {
+		if err := flag.CommandLine.Parse(rest); err != nil {
+			return a, errors.Wrap(err)
+		}
+		remaining := flag.Args()
+		// after a -- everything is positional
+		if len(remaining) == 0 || len(remaining) < len(rest) && rest[len(rest)-len(remaining)-1] == "--" {
+			positional = append(positional, remaining...)
+			break
+		}
+		positional, rest = append(positional, remaining[0]), remaining[1:]
+	}
+	if len(positional) > 0 {
+		a.Command, a.CommandArgs = positional[0], positional[1:]
+	}
+	var err error
+	if a.Sources, err = a.loadConfig(); err != nil {
+		return a, errors.Wrap(err)
+	}
+	if err = a.resolveDB(); err != nil {
+		return a, errors.Wrap(err)
+	}
+
+	if a.Command != "" {
+		if _, ok := Commands[a.Command]; !ok {
+			return a, errors.Errorf("unknown command %s", a.Command)
+		}
+		if a.Command == "remap-root" && len(a.CommandArgs) != 2 {
+			return a, errors.New("remap-root requires a root name and path")
+		}
+		if (a.Command == "tag" || a.Command == "untag" || a.Command == "note") && len(a.CommandArgs) < 2 {
+			return a, errors.Errorf("%s requires the path of an image and what to %s it with", a.Command, a.Command)
+		}
+		if (a.Command == "unnote" || a.Command == "unedit") && len(a.CommandArgs) != 1 {
+			return a, errors.Errorf("%s requires the path of an image", a.Command)
+		}
+		if a.Command == "save-search" && len(a.CommandArgs) < 2 {
+			return a, errors.New("save-search requires a name and what to search for")
+		}
+		if a.Command == "delete-search" && len(a.CommandArgs) != 1 {
+			return a, errors.New("delete-search requires the name of a saved search")
+		}
+		if a.Command == "config" && (len(a.CommandArgs) != 1 || a.CommandArgs[0] != "show") {
+			return a, errors.New("config requires show")
+		}
+		if a.Command == "edit" && len(a.CommandArgs) == 0 {
+			return a, errors.New("edit requires the path of an image")
+		}
+		if a.Command != "index" {
+			return a, nil
+		}
+	} else if a.Clear || a.IsSearch() || a.ListEntities {
+		// short circuit if we aren't parsing images
 		return a, nil
 	}
 
-	var err error
+	if a.IsStdinImage() {
+		if len(a.CommandArgs) > 1 {
+			return a, errors.New("index - reads a single image from stdin, so it can't be given other paths")
+		}
+		if a.StdinName == "" {
+			return a, errors.New("index - requires -name")
+		}
+		if a.FilesFrom == "-" {
+			return a, errors.New("index - and -files-from - can't both read stdin")
+		}
+	} else if len(a.ImageDirs) == 0 && len(a.CommandArgs) == 0 && a.FilesFrom == "" {
+		return a, errors.New("-dir or -files-from required")
+	}
 
-	if a.ImageDir == "" {
-		return a, errors.New("-dir required")
+	if a.Workers == 0 {
+		return a, errors.New("-workers must be at least 1")
+	}
+
+	if a.ThumbSize < 0 {
+		return a, errors.New("-thumb-size can't be negative")
 	}
 
 	if a.trainedDataPath != "" {
@@ -56,3 +321,48 @@ func ParseFlags() (Args, error) {
 
 	return a, nil
 }
+
+// IsStdinImage reports whether the index command should parse an image from stdin.
+func (a Args) IsStdinImage() bool {
+	return a.Command == "index" && slices.Contains(a.CommandArgs, "-")
+}
+
+// IsSearch reports whether searmage should search instead of parsing images, without a command.
+func (a Args) IsSearch() bool {
+	return a.Search != "" || len(a.Tags) > 0
+}
+
+// funcFlag is flag.Func, remembering the values the flag was set to in values so config show can print them.
+func funcFlag(values map[string][]string, name, usage string, fn func(string) error) {
+	flag.Func(name, usage, func(s string) error {
+		values[name] = append(values[name], s)
+		return fn(s)
+	})
+}
+
+// globFlag validates globs before appending them to globs.
+func globFlag(globs *[]string) func(string) error {
+	return func(s string) error {
+		if _, err := path.Match(s, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %s", s)
+		}
+		*globs = append(*globs, s)
+		return nil
+	}
+}
+
+// takenAtFlag parses a date or time flag for filtering by when a photo was taken.
+func takenAtFlag(t *time.Time) func(string) error {
+	return func(s string) (err error) {
+		*t, err = db.ParseTakenAt(s)
+		return errors.Wrap(err)
+	}
+}
+
+func detectorNames() string {
+	names := make([]string, len(audit.Detectors))
+	for i, d := range audit.Detectors {
+		names[i] = d.Name
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,388 @@
+package cfg
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Source is where a flag's value came from. Flags override the environment, which overrides the config file, which overrides the defaults.
+type Source string
+
+const (
+	SourceFlag    Source = "flag"
+	SourceEnv     Source = "env"
+	SourceFile    Source = "file"
+	SourceDefault Source = "default"
+)
+
+// envPrefix prefixes the environment variable of each flag, e.g. SEARMAGE_TRAINED_DATA for -trained-data.
+const envPrefix = "SEARMAGE_"
+
+// configExts are the extensions of the config files looked for, config.toml and so on within $XDG_CONFIG_HOME/searmage/, or searmage.toml and so on beside the database.
+var configExts = []string{".toml", ".yaml", ".yml", ".json"}
+
+// unconfigurable flags can only be given on the command line. -clear deletes the database, so it's never left in a config file by accident.
+var unconfigurable = map[string]bool{"config": true, "clear": true}
+
+// envName returns the environment variable that sets the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig sets the flags that weren't given on the command line from the environment, then from the config file.
+// It returns where each flag's value came from.
+func (a *Args) loadConfig() (map[string]Source, error) {
+	sources := map[string]Source{}
+	flag.VisitAll(func(f *flag.Flag) { sources[f.Name] = SourceDefault })
+	flag.Visit(func(f *flag.Flag) { sources[f.Name] = SourceFlag })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if err != nil || !ok || sources[f.Name] != SourceDefault || unconfigurable[f.Name] {
+			return
+		}
+		sources[f.Name] = SourceEnv
+		err = errors.Wrapf(flag.Set(f.Name, value), "%s", envName(f.Name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sources["config"] == SourceDefault {
+		a.ConfigPath = os.Getenv(envName("config"))
+	}
+
+	dbPath, err := a.databasePath(sources)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	if a.ConfigPath, err = a.findConfig(dbPath); err != nil || a.ConfigPath == "" {
+		return sources, errors.Wrap(err)
+	}
+	settings, err := readConfig(a.ConfigPath)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	for name, values := range settings {
+		if unconfigurable[name] {
+			return nil, errors.Errorf("%s: %s may only be given as a flag", a.ConfigPath, name)
+		} else if flag.Lookup(name) == nil {
+			return nil, errors.Errorf("%s: unknown setting %s", a.ConfigPath, name)
+		}
+		if sources[name] != SourceDefault || len(values) == 0 {
+			continue
+		}
+		sources[name] = SourceFile
+		for _, v := range values {
+			if err = flag.Set(name, expandHome(v)); err != nil {
+				return nil, errors.Wrapf(err, "%s: %s", a.ConfigPath, name)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// findConfig returns -config if it was given, or the first config file found within $XDG_CONFIG_HOME/searmage/ or beside the database at dbPath.
+// It returns an empty path if there isn't one.
+func (a *Args) findConfig(dbPath string) (string, error) {
+	if a.ConfigPath != "" {
+		_, err := os.Stat(a.ConfigPath)
+		return a.ConfigPath, errors.Wrapf(err, "-config")
+	}
+
+	var candidates []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		for _, ext := range configExts {
+			candidates = append(candidates, filepath.Join(dir, "searmage", "config"+ext))
+		}
+	}
+	for _, ext := range configExts {
+		candidates = append(candidates, filepath.Join(filepath.Dir(dbPath), "searmage"+ext))
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+	return "", nil
+}
+
+// expandHome replaces a leading ~/ with the home directory, since the shell doesn't expand paths within a config file.
+func expandHome(s string) string {
+	rest, ok := strings.CutPrefix(s, "~/")
+	if !ok {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return s
+	}
+	return filepath.Join(home, rest)
+}
+
+// readConfig reads the settings within the config file at path, by it's extension.
+// Each setting is a flag's name, with several values for flags that may be repeated.
+func readConfig(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.ReadFile")
+	}
+	var settings map[string][]string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		settings, err = parseJSON(data)
+	case ".toml":
+		settings, err = parseLines(string(data), "=", false)
+	case ".yaml", ".yml":
+		settings, err = parseLines(string(data), ":", true)
+	default:
+		return nil, errors.Errorf("%s: config files must end in .toml, .yaml, .yml or .json", path)
+	}
+	return settings, errors.Wrapf(err, "%s", path)
+}
+
+// parseJSON parses a JSON object of flag names to strings, numbers, booleans or arrays of them.
+func parseJSON(data []byte) (map[string][]string, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrapf(err, "json.Unmarshal")
+	}
+	settings := make(map[string][]string, len(raw))
+	for name, v := range raw {
+		items, ok := v.([]any)
+		if !ok {
+			items = []any{v}
+		}
+		for _, item := range items {
+			switch item := item.(type) {
+			case string:
+				settings[name] = append(settings[name], item)
+			case float64:
+				settings[name] = append(settings[name], strconv.FormatFloat(item, 'f', -1, 64))
+			case bool:
+				settings[name] = append(settings[name], strconv.FormatBool(item))
+			default:
+				return nil, errors.Errorf("%s must be a string, number, boolean or an array of them", name)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// parseLines parses the subset of TOML or YAML a config file needs, a flat list of keys and values separated by sep.
+// Values are strings, numbers, booleans, or arrays of them written inline like [a, b]. TOML arrays may span lines,
+// and YAML may list values under a key on lines starting with -. Tables and nested mappings aren't supported.
+func parseLines(text, sep string, yaml bool) (map[string][]string, error) {
+	settings := map[string][]string{}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	// listKey is the YAML key whose values are listed on the lines below it
+	listKey := ""
+	for i := 0; i < len(lines); i++ {
+		lineNum := i + 1
+		line := strings.TrimSpace(stripComment(lines[i], yaml))
+		if line == "" || yaml && (line == "---" || line == "...") {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(line, "-"); yaml && ok && (item == "" || item[0] == ' ') {
+			if listKey == "" {
+				return nil, errors.Errorf("line %d: list item without a key", lineNum)
+			}
+			v, err := unquote(strings.TrimSpace(item), yaml)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", lineNum)
+			}
+			settings[listKey] = append(settings[listKey], v)
+			continue
+		}
+		if yaml && (lines[i][0] == ' ' || lines[i][0] == '\t') {
+			return nil, errors.Errorf("line %d: nested settings aren't supported", lineNum)
+		}
+		if !yaml && strings.HasPrefix(line, "[") {
+			return nil, errors.Errorf("line %d: tables aren't supported, settings must be at the top of the file", lineNum)
+		}
+
+		key, value, ok := strings.Cut(line, sep)
+		if !ok {
+			return nil, errors.Errorf("line %d: expected key %s value", lineNum, sep)
+		}
+		key, err := unquote(strings.TrimSpace(key), yaml)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNum)
+		}
+		value, listKey = strings.TrimSpace(value), ""
+		if value == "" && yaml {
+			listKey, settings[key] = key, nil
+			continue
+		}
+		// TOML arrays may continue on the following lines until they're closed
+		for !yaml && strings.HasPrefix(value, "[") && !closedArray(value) && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(lines[i], yaml))
+		}
+		if settings[key], err = parseValue(value, yaml); err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNum)
+		}
+	}
+	return settings, nil
+}
+
+// parseValue parses a scalar, or an inline array of them.
+func parseValue(value string, yaml bool) ([]string, error) {
+	inner, ok := strings.CutPrefix(value, "[")
+	if !ok {
+		v, err := unquote(value, yaml)
+		return []string{v}, errors.Wrap(err)
+	}
+	if inner, ok = strings.CutSuffix(inner, "]"); !ok {
+		return nil, errors.Errorf("unclosed array %s", value)
+	}
+	var values []string
+	for _, item := range splitArray(inner) {
+		if item = strings.TrimSpace(item); item == "" {
+			// a trailing comma
+			continue
+		}
+		v, err := unquote(item, yaml)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// unquote returns the string within double or single quotes, or s itself if it isn't quoted.
+// Double quoted strings may contain escapes, while single quoted ones are literal, except that YAML doubles single quotes within them.
+func unquote(s string, yaml bool) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		return v, errors.Wrapf(err, "invalid string %s", s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		v := s[1 : len(s)-1]
+		if yaml {
+			v = strings.ReplaceAll(v, "''", "'")
+		}
+		return v, nil
+	case len(s) > 0 && (s[0] == '"' || s[0] == '\''):
+		return "", errors.Errorf("unterminated string %s", s)
+	}
+	return s, nil
+}
+
+// quoteState tracks whether we're within a quoted string while scanning a line.
+type quoteState struct {
+	quote   byte
+	escaped bool
+}
+
+// next updates the state with the next byte of the line, returning whether it's outside of any string.
+func (q *quoteState) next(c byte) (outside bool) {
+	switch {
+	case q.escaped:
+		q.escaped = false
+	case q.quote == '"' && c == '\\':
+		q.escaped = true
+	case q.quote != 0 && c == q.quote:
+		q.quote = 0
+	case q.quote == 0 && (c == '"' || c == '\''):
+		q.quote = c
+	case q.quote == 0:
+		return true
+	}
+	return false
+}
+
+// stripComment removes a # comment from the end of line, unless it's within a string.
+// YAML only starts comments with a # at the start of the line or after whitespace.
+func stripComment(line string, yaml bool) string {
+	var q quoteState
+	for i := 0; i < len(line); i++ {
+		if q.next(line[i]) && line[i] == '#' && (!yaml || i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// closedArray reports whether the array starting value is closed by a ] outside of a string.
+func closedArray(value string) bool {
+	var q quoteState
+	for i := 0; i < len(value); i++ {
+		if q.next(value[i]) && value[i] == ']' {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArray splits the items of an inline array at the commas outside of strings.
+func splitArray(inner string) []string {
+	var items []string
+	var q quoteState
+	start := 0
+	for i := 0; i < len(inner); i++ {
+		if q.next(inner[i]) && inner[i] == ',' {
+			items, start = append(items, inner[start:i]), i+1
+		}
+	}
+	return append(items, inner[start:])
+}
+
+// ShowConfig writes the effective value of every setting as TOML, commented with where it came from, so it may be used as a config file.
+func (a Args) ShowConfig(w io.Writer) error {
+	source := "none found"
+	if a.ConfigPath != "" {
+		source = a.ConfigPath
+	}
+	if _, err := fmt.Fprintf(w, "# config file: %s\n# database: %s\n", source, a.DBPath); err != nil {
+		return errors.Wrapf(err, "fmt.Fprintf")
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || unconfigurable[f.Name] {
+			return
+		}
+		values, isFunc := a.funcValues[f.Name]
+		if !isFunc {
+			values = []string{f.Value.String()}
+		}
+		var line string
+		switch {
+		case len(values) == 0 || values[0] == "" && len(values) == 1:
+			line = fmt.Sprintf("# %s uses it's default", f.Name)
+		case isBoolFlag(f) || !isFunc && isNumber(values[0]):
+			line = fmt.Sprintf("%s = %s # %s", f.Name, values[0], a.Sources[f.Name])
+		case len(values) == 1:
+			line = fmt.Sprintf("%s = %s # %s", f.Name, strconv.Quote(values[0]), a.Sources[f.Name])
+		default:
+			quoted := make([]string, len(values))
+			for i, v := range values {
+				quoted[i] = strconv.Quote(v)
+			}
+			line = fmt.Sprintf("%s = [%s] # %s", f.Name, strings.Join(quoted, ", "), a.Sources[f.Name])
+		}
+		_, err = fmt.Fprintln(w, line)
+	})
+	return errors.Wrapf(err, "fmt.Fprintln")
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
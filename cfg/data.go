@@ -0,0 +1,89 @@
+package cfg
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// DefaultIndex is the name of the database used when neither -db nor -index are set.
+const DefaultIndex = "default"
+
+// DataDir returns the directory searmage keeps it's databases in, $XDG_DATA_HOME/searmage or the platform's equivalent.
+// It falls back to the temp directory if there's no home directory to put it in.
+func DataDir() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if !filepath.IsAbs(dir) {
+		// the spec says relative paths are invalid and should be ignored
+		dir = ""
+		home, err := os.UserHomeDir()
+		switch {
+		case runtime.GOOS == "windows":
+			dir = os.Getenv("LocalAppData")
+		case err != nil:
+		case runtime.GOOS == "darwin":
+			dir = filepath.Join(home, "Library", "Application Support")
+		default:
+			dir = filepath.Join(home, ".local", "share")
+		}
+	}
+	return filepath.Join(cmp.Or(dir, os.TempDir()), "searmage")
+}
+
+// legacyDBPath is where the database was kept by default before DataDir, which is usually emptied on reboot.
+func legacyDBPath() string {
+	return filepath.Join(os.TempDir(), "searmage.sqlite3")
+}
+
+// sourceOrder ranks sources from highest precedence to lowest.
+var sourceOrder = []Source{SourceFlag, SourceEnv, SourceFile, SourceDefault}
+
+// databasePath returns -db, or the database named by -index within DataDir.
+// If both are set the one with the higher precedence wins, e.g. -index work overrides a db within the config file.
+func (a *Args) databasePath(sources map[string]Source) (string, error) {
+	if a.DBPath != "" && a.Index != "" {
+		dbRank, indexRank := slices.Index(sourceOrder, sources["db"]), slices.Index(sourceOrder, sources["index"])
+		if dbRank == indexRank {
+			return "", errors.New("-db and -index can't both be set")
+		} else if dbRank < indexRank {
+			return a.DBPath, nil
+		}
+	} else if a.DBPath != "" {
+		return a.DBPath, nil
+	}
+
+	name := cmp.Or(a.Index, DefaultIndex)
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", errors.Errorf("-index %s must be a name, not a path. Use -db for databases elsewhere", name)
+	}
+	return filepath.Join(DataDir(), name+".sqlite3"), nil
+}
+
+// resolveDB sets DBPath to the database that will be used, creating DataDir if it's within it.
+// If the default database doesn't exist yet but one was left in the temp directory by an older searmage, it's noted in LegacyDBPath.
+func (a *Args) resolveDB() (err error) {
+	if a.DBPath, err = a.databasePath(a.Sources); err != nil {
+		return errors.Wrap(err)
+	}
+	if filepath.Dir(a.DBPath) != DataDir() {
+		return nil
+	}
+	if err = os.MkdirAll(DataDir(), 0o700); err != nil {
+		return errors.Wrapf(err, "os.MkdirAll")
+	}
+
+	if a.DBPath != filepath.Join(DataDir(), DefaultIndex+".sqlite3") {
+		return nil
+	}
+	if _, err = os.Stat(a.DBPath); !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err = os.Stat(legacyDBPath()); err == nil {
+		a.LegacyDBPath = legacyDBPath()
+	}
+	return nil
+}
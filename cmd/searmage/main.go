@@ -1,16 +1,29 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage"
+	"github.com/danlock/searmage/audit"
 	"github.com/danlock/searmage/cfg"
 	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/events"
 	"github.com/danlock/searmage/ocr"
+	"github.com/danlock/searmage/server"
 )
 
 var (
@@ -23,7 +36,11 @@ func main() {
 	defer cancel()
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s (Version=%s,%s) :\n", os.Args[0], buildTag, buildInfo)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s (Version=%s,%s) : %s [command] [flags]\nCommands:\n", os.Args[0], buildTag, buildInfo, os.Args[0])
+		for _, cmd := range slices.Sorted(maps.Keys(cfg.Commands)) {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\n    \t%s\n", cmd, cfg.Commands[cmd])
+		}
+		fmt.Fprintln(flag.CommandLine.Output(), "Flags:")
 		flag.PrintDefaults()
 	}
 
@@ -38,12 +55,43 @@ func main() {
 		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
 	}
 
+	if args.Command == "config" {
+		if err = args.ShowConfig(os.Stdout); err != nil {
+			slog.Error("config", "err", err)
+		}
+		return
+	}
+
 	if args.Clear {
-		slog.Info("-clear was set, database gone...", "err", os.Remove(args.DBPath))
+		// the default database doesn't exist yet if there's a legacy one, which would otherwise be copied back next run
+		clearPath := cmp.Or(args.LegacyDBPath, args.DBPath)
+		slog.Info("-clear was set, database gone...", "path", clearPath, "err", os.Remove(clearPath))
 		return
 	}
 
-	args.DB, err = db.Setup(ctx, args.DBPath)
+	if args.LegacyDBPath != "" {
+		if err = copyLegacyDB(ctx, args.LegacyDBPath, args.DBPath); err != nil {
+			slog.Warn("failed copying the database out of the temp directory, using it there for now", "path", args.LegacyDBPath, "err", err)
+			args.DBPath = args.LegacyDBPath
+		} else {
+			slog.Info("copied the database out of the temp directory, where it'd be lost on reboot. The old one is no longer used and may be deleted",
+				"from", args.LegacyDBPath, "to", args.DBPath)
+		}
+	}
+
+	// Without a command or search, we parse images
+	if args.Command == "index" || args.Command == "" && !args.IsSearch() && !args.ListEntities {
+		if err = index(ctx, args); err != nil {
+			slog.Error("ocr", "err", err)
+		}
+		return
+	}
+
+	setupDB := db.Setup
+	if args.Command == "serve" && !args.AllowEdits {
+		setupDB = db.SetupReadOnly
+	}
+	args.DB, err = setupDB(ctx, args.DBPath)
 	if err != nil {
 		slog.Error("sqlite", "err", err)
 		flag.Usage()
@@ -55,14 +103,530 @@ func main() {
 		}
 	}()
 
-	if args.Search != "" {
-		images, err := db.SearchParsedText(ctx, args.DB, args.Search, args.IsRegex)
-		slog.Info("-search was set, found the following...", "err", err, "images", images)
+	roots, err := db.LoadRoots(ctx, args.DB, args.Roots)
+	if err != nil {
+		slog.Error("roots", "err", err)
+		os.Exit(1)
+	}
+
+	switch args.Command {
+	case "maintain":
+		unlock, err := db.LockWriter(args.DBPath)
+		if err != nil {
+			slog.Error("maintain", "err", err)
+			return
+		}
+		defer unlock()
+
+		report, err := db.Maintain(ctx, args.DB, args.DBPath, args.VacuumInto)
+		slog.Info("maintain finished", "err", err, "report", report)
+		return
+	case "prune":
+		unlock, err := db.LockWriter(args.DBPath)
+		if err != nil {
+			slog.Error("prune", "err", err)
+			return
+		}
+		defer unlock()
+
+		rep, err := newReporter(args)
+		if err != nil {
+			slog.Error("prune", "err", err)
+			return
+		}
+		defer rep.Close()
+
+		pruned, err := db.Prune(ctx, args.DB, roots)
+		for _, p := range pruned {
+			slog.Info("pruned", "path", p.Path)
+			rep.report(ctx, events.Event{Type: events.Pruned, Time: time.Now(), Path: p.Path, ImageID: p.ImageID, Hash: p.Hash}, nil)
+		}
+		slog.Info("prune finished", "err", err, "count", len(pruned))
+		return
+	case "rehash":
+		unlock, err := db.LockWriter(args.DBPath)
+		if err != nil {
+			slog.Error("rehash", "err", err)
+			return
+		}
+		defer unlock()
+
+		report, err := db.Rehash(ctx, args.DB, roots, args.Hash)
+		slog.Info("rehash finished", "err", err, "hash", args.Hash, "report", report)
+		return
+	case "export":
+		out := os.Stdout
+		if len(args.CommandArgs) > 0 && args.CommandArgs[0] != "-" {
+			if out, err = os.Create(args.CommandArgs[0]); err != nil {
+				slog.Error("export", "err", err)
+				return
+			}
+			defer out.Close()
+		}
+
+		count, err := db.Export(ctx, args.DB, roots, out)
+		slog.Info("export finished", "err", err, "count", count)
+		return
+	case "import":
+		in := os.Stdin
+		if len(args.CommandArgs) > 0 && args.CommandArgs[0] != "-" {
+			if in, err = os.Open(args.CommandArgs[0]); err != nil {
+				slog.Error("import", "err", err)
+				return
+			}
+			defer in.Close()
+		}
+
+		unlock, err := db.LockWriter(args.DBPath)
+		if err != nil {
+			slog.Error("import", "err", err)
+			return
+		}
+		defer unlock()
+
+		report, err := db.Import(ctx, args.DB, roots, in, args.RewritePath)
+		slog.Info("import finished", "err", err, "report", report)
+		return
+	case "serve":
+		srv := server.Server{DB: args.DB, Roots: roots, ThumbSize: args.ThumbSize, AllowEdits: args.AllowEdits, DBPath: args.DBPath}
+		if err = server.ListenAndServe(ctx, args.Addr, srv.Handler()); err != nil {
+			slog.Error("serve", "err", err)
+		}
+		return
+	case "audit":
+		detectors := args.Detectors
+		if len(detectors) == 0 {
+			detectors = audit.Detectors
+		}
+		results, err := db.Audit(ctx, args.DB, roots, detectors)
+		for _, r := range results {
+			for _, f := range r.Findings {
+				slog.Info("audit", "detector", f.Detector, "match", f.Match, "region", f.Region(), "paths", r.Paths)
+			}
+		}
+		slog.Info("audit finished", "err", err, "images", len(results))
+		return
+	case "tag", "untag", "note", "unnote":
+		hash, err := editTags(ctx, args, roots)
+		slog.Info(args.Command+" finished", "err", err, "hash", hash)
+		return
+	case "edit", "unedit":
+		imageID, err := editText(ctx, args, roots)
+		slog.Info(args.Command+" finished", "err", err, "image_id", imageID)
+		return
+	case "save-search":
+		unlock, err := db.LockWriter(args.DBPath)
+		if err != nil {
+			slog.Error("save-search", "err", err)
+			return
+		}
+		defer unlock()
+
+		s := db.SavedSearch{Name: args.CommandArgs[0], Text: strings.Join(args.CommandArgs[1:], " "), Mode: db.SearchMatch}
+		if args.IsRegex {
+			s.Mode = db.SearchRegex
+		}
+		err = db.SaveSearch(ctx, args.DB, s)
+		slog.Info("save-search finished", "err", err, "name", s.Name, "text", s.Text, "mode", s.Mode)
+		return
+	case "delete-search":
+		unlock, err := db.LockWriter(args.DBPath)
+		if err != nil {
+			slog.Error("delete-search", "err", err)
+			return
+		}
+		defer unlock()
+
+		err = db.DeleteSavedSearch(ctx, args.DB, args.CommandArgs[0])
+		slog.Info("delete-search finished", "err", err, "name", args.CommandArgs[0])
+		return
+	case "searches":
+		searches, err := db.SavedSearches(ctx, args.DB)
+		for _, s := range searches {
+			slog.Info("saved search", "name", s.Name, "text", s.Text, "mode", s.Mode, "checked_at", s.CheckedAt)
+		}
+		slog.Info("searches finished", "err", err, "count", len(searches))
+		return
+	case "check":
+		count, err := check(ctx, args, roots)
+		slog.Info("check finished", "err", err, "count", count)
+		return
+	case "duplicates":
+		groups, err := db.Duplicates(ctx, args.DB, roots)
+		var wasted int64
+		for _, g := range groups {
+			slog.Info("duplicates", "hash", g.Hash, "size", g.Size, "copies", len(g.Paths), "paths", g.Paths)
+			wasted += g.Wasted()
+		}
+		slog.Info("duplicates finished", "err", err, "groups", len(groups), "wasted bytes", wasted)
+		return
+	case "similar":
+		if len(args.CommandArgs) > 0 {
+			dhash, err := dhashFile(args.CommandArgs[0])
+			if err != nil {
+				slog.Error("similar", "err", err)
+				return
+			}
+			similar, err := db.SimilarTo(ctx, args.DB, roots, dhash, args.MaxDistance)
+			for _, s := range similar {
+				slog.Info("similar", "distance", s.Distance, "hash", s.Hash, "paths", s.Paths)
+			}
+			slog.Info("similar finished", "err", err, "count", len(similar))
+			return
+		}
+
+		groups, err := db.SimilarGroups(ctx, args.DB, roots, args.MaxDistance)
+		for i, g := range groups {
+			for _, s := range g {
+				slog.Info("similar", "group", i+1, "distance", s.Distance, "hash", s.Hash, "paths", s.Paths)
+			}
+		}
+		slog.Info("similar finished", "err", err, "groups", len(groups))
+		return
+	case "roots":
+		slog.Info("roots", "roots", roots)
+		return
+	case "remap-root":
+		name, rootPath := args.CommandArgs[0], args.CommandArgs[1]
+		if !slices.ContainsFunc(roots, func(r db.Root) bool { return r.Name == name }) {
+			slog.Error("remap-root", "err", "no root named "+name, "roots", roots)
+			return
+		}
+		err = db.SetRoot(ctx, args.DB, name, rootPath)
+		slog.Info("remap-root finished", "err", err, "name", name, "path", rootPath)
+		return
+	}
+
+	q := db.Query{
+		Text:        args.Search,
+		Mode:        db.SearchMatch,
+		Format:      args.Format,
+		Camera:      args.Camera,
+		TakenAfter:  args.TakenAfter,
+		TakenBefore: args.TakenBefore,
+		HasLocation: args.HasLocation,
+		Collapse:    args.Collapse,
+		MaxDistance: args.MaxDistance,
+		Tags:        args.Tags,
+	}
+	if args.ListEntities {
+		found, err := db.Entities(ctx, args.DB, roots, args.Entity, q)
+		for _, e := range found {
+			slog.Info("entity", "type", e.Type, "value", e.Value, "paths", e.Paths)
+		}
+		slog.Info("-entity finished", "err", err, "count", len(found))
 		return
 	}
+	if args.SimilarTo != "" {
+		dhash, err := dhashFile(args.SimilarTo)
+		if err != nil {
+			slog.Error("-similar-to", "err", err)
+			return
+		}
+		q.SimilarTo = &dhash
+	}
+	if args.IsRegex {
+		q.Mode = db.SearchRegex
+	}
+	images, err := db.SearchParsedText(ctx, args.DB, roots, q)
+	slog.Info("-search was set, found the following...", "err", err, "images", images)
+}
+
+// index parses the images within -dir, -files-from and the index command's paths that aren't in the database yet,
+// or the image on stdin for index -.
+func index(ctx context.Context, args cfg.Args) error {
+	opts := searmage.IndexerOptions{
+		DBPath:         args.DBPath,
+		Workers:        args.Workers,
+		ThumbSize:      args.ThumbSize,
+		Hash:           searmage.HashAlgorithm(args.Hash),
+		Barcodes:       args.Barcodes,
+		OverwriteEdits: args.OverwriteEdits,
+		Roots:          args.Roots,
+		Include:        args.Include,
+		Exclude:        args.Exclude,
+		SkipHidden:     args.SkipHidden,
+		FollowSymlinks: args.FollowSymlinks,
+		Progress:       os.Stderr,
+	}
+	// -thumb-size 0 disables thumbnails, unlike IndexerOptions where 0 is the default
+	if args.ThumbSize == 0 {
+		opts.ThumbSize = -1
+	}
+	if args.TrainedData != nil {
+		opts.TrainedData = args.TrainedData
+	}
+	rep, err := newReporter(args)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer rep.Close()
+	opts.OnIndexed = func(ctx context.Context, img searmage.IndexedImage) {
+		if img.Err != nil {
+			rep.report(ctx, events.Event{Type: events.Failed, Time: time.Now(), Path: img.Path, Error: img.Err.Error()}, nil)
+			return
+		}
+		rep.report(ctx, events.Event{Type: events.Indexed, Time: time.Now(), Path: img.Path, ImageID: img.ImageID, Hash: img.Hash, Text: img.Text}, strings.NewReader(img.Text))
+		for _, s := range img.Matches {
+			slog.Info("saved search matched", "search", s.Name, "path", img.Path)
+			rep.report(ctx, events.Event{Type: events.Matched, Time: time.Now(), Path: img.Path, ImageID: img.ImageID, Hash: img.Hash, Search: s.Name}, nil)
+		}
+	}
+
+	ix, err := searmage.NewIndexer(ctx, opts)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer ix.Close()
+
+	if args.IsStdinImage() {
+		if err = ix.IndexReader(ctx, args.StdinName, os.Stdin); err != nil {
+			return errors.Wrap(err)
+		}
+		slog.Info("Finished parsing", "name", args.StdinName)
+		return nil
+	}
+
+	paths := slices.Concat(args.ImageDirs, args.CommandArgs)
+	if args.FilesFrom != "" {
+		list := os.Stdin
+		if args.FilesFrom != "-" {
+			if list, err = os.Open(args.FilesFrom); err != nil {
+				return errors.Wrapf(err, "-files-from")
+			}
+			defer list.Close()
+		}
+		listed, err := ocr.ReadPathList(list)
+		if err != nil {
+			return errors.Wrapf(err, "-files-from")
+		}
+		paths = append(paths, listed...)
+	}
+
+	slog.Info("searmage processing...", "-dir", args.ImageDirs, "paths", len(paths), "workers", args.Workers)
+	report, err := ix.Index(ctx, paths)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	if report.Found == 0 {
+		slog.Info("Found 0 unparsed images", "paths", len(paths))
+		return nil
+	}
+	slog.Info("Finished parsing", "count", report.Indexed, "failed", report.Failed, "duration", report.Duration,
+		"p50", report.P50, "p90", report.P90, "p99", report.P99, "max", report.Max)
+	return nil
+}
+
+// check lists the images indexed since the saved searches named by the check command, or all of them, were last checked that match them.
+// It returns how many matches it found.
+func check(ctx context.Context, args cfg.Args, roots db.Roots) (int, error) {
+	unlock, err := db.LockWriter(args.DBPath)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	defer unlock()
+
+	names := args.CommandArgs
+	if len(names) == 0 {
+		searches, err := db.SavedSearches(ctx, args.DB)
+		if err != nil {
+			return 0, errors.Wrap(err)
+		}
+		for _, s := range searches {
+			names = append(names, s.Name)
+		}
+	}
+	rep, err := newReporter(args)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	defer rep.Close()
+
+	count := 0
+	for _, name := range names {
+		results, err := db.CheckSavedSearch(ctx, args.DB, roots, name)
+		if err != nil {
+			return count, errors.Wrap(err)
+		}
+		for _, r := range results {
+			slog.Info("saved search matched", "search", name, "path", r.Path, "image_id", r.ImageID)
+			rep.report(ctx, events.Event{Type: events.Matched, Time: time.Now(), Path: r.Path, ImageID: r.ImageID, Hash: r.Hash, Search: name}, nil)
+		}
+		count += len(results)
+	}
+	return count, nil
+}
+
+// reporter writes events to -events and runs the commands hooked to them.
+type reporter struct {
+	events *events.Writer
+	hooks  map[events.Type]string
+}
+
+func newReporter(args cfg.Args) (*reporter, error) {
+	r := &reporter{hooks: map[events.Type]string{events.Indexed: args.OnIndexed, events.Failed: args.OnFailed, events.Matched: args.OnMatch}}
+	if args.Events != "" {
+		var err error
+		if r.events, err = events.Open(args.Events); err != nil {
+			return nil, errors.Wrapf(err, "-events")
+		}
+	}
+	return r, nil
+}
+
+// report writes e and runs it's hook with stdin, logging instead of returning errors so one failing doesn't stop the others.
+func (r *reporter) report(ctx context.Context, e events.Event, stdin io.Reader) {
+	if r.events != nil {
+		if err := r.events.Write(e); err != nil {
+			slog.Warn("failed writing event", "type", e.Type, "path", e.Path, "err", err)
+		}
+	}
+	if hook := r.hooks[e.Type]; hook != "" {
+		if err := events.Run(ctx, hook, e, stdin); err != nil {
+			slog.Warn("failed running hook", "type", e.Type, "path", e.Path, "err", err)
+		}
+	}
+}
+
+func (r *reporter) Close() error {
+	if r.events == nil {
+		return nil
+	}
+	return errors.Wrap(r.events.Close())
+}
+
+// editTags runs the tag, untag, note or unnote command on the image at the path given after it, returning it's hash.
+func editTags(ctx context.Context, args cfg.Args, roots db.Roots) (string, error) {
+	unlock, err := db.LockWriter(args.DBPath)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	defer unlock()
+
+	imgPath, err := filepath.Abs(args.CommandArgs[0])
+	if err != nil {
+		return "", errors.Wrapf(err, "filepath.Abs")
+	}
+	hash, err := db.ImageHash(ctx, args.DB, roots, imgPath, args.Hash)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+
+	switch args.Command {
+	case "tag":
+		err = db.AddTags(ctx, args.DB, hash, args.CommandArgs[1:])
+	case "untag":
+		err = db.RemoveTags(ctx, args.DB, hash, args.CommandArgs[1:])
+	case "note":
+		err = db.SetNote(ctx, args.DB, hash, strings.Join(args.CommandArgs[1:], " "))
+	case "unnote":
+		err = db.SetNote(ctx, args.DB, hash, "")
+	}
+	return hash, errors.Wrap(err)
+}
+
+// editText runs the edit or unedit command on the image at the path given after it, returning it's id.
+func editText(ctx context.Context, args cfg.Args, roots db.Roots) (int64, error) {
+	imgPath, err := filepath.Abs(args.CommandArgs[0])
+	if err != nil {
+		return 0, errors.Wrapf(err, "filepath.Abs")
+	}
+	imageID, _, err := db.FindImage(ctx, args.DB, roots, imgPath, args.Hash)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	var text string
+	switch {
+	case args.Command == "unedit":
+	case len(args.CommandArgs) == 2 && args.CommandArgs[1] == "-":
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return imageID, errors.Wrapf(err, "io.ReadAll")
+		}
+		text = string(stdin)
+	case len(args.CommandArgs) > 1:
+		text = strings.Join(args.CommandArgs[1:], " ")
+	default:
+		img, err := db.GetImage(ctx, args.DB, roots, imageID)
+		if err != nil {
+			return imageID, errors.Wrap(err)
+		}
+		if text, err = editInEditor(img.Text); err != nil {
+			return imageID, errors.Wrap(err)
+		}
+		if text == img.Text {
+			return imageID, errors.New("the text wasn't changed")
+		}
+	}
+
+	// the lock is only taken once the text is ready, so it isn't held while someone's typing
+	unlock, err := db.LockWriter(args.DBPath)
+	if err != nil {
+		return imageID, errors.Wrap(err)
+	}
+	defer unlock()
+	if args.Command == "unedit" {
+		return imageID, errors.Wrap(db.RevertEdit(ctx, args.DB, imageID))
+	}
+	return imageID, errors.Wrap(db.EditText(ctx, args.DB, imageID, text))
+}
+
+// editInEditor opens text in $VISUAL or $EDITOR, falling back to vi, and returns what it was saved as.
+func editInEditor(text string) (string, error) {
+	f, err := os.CreateTemp("", "searmage-edit-*.txt")
+	if err != nil {
+		return "", errors.Wrapf(err, "os.CreateTemp")
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "f.WriteString")
+	}
+
+	editor := cmp.Or(os.Getenv("VISUAL"), os.Getenv("EDITOR"), "vi")
+	// editors like "code --wait" come with their own arguments
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "%s", editor)
+	}
+	edited, err := os.ReadFile(f.Name())
+	return string(edited), errors.Wrapf(err, "os.ReadFile")
+}
+
+// copyLegacyDB copies the database an older searmage kept in the temp directory to dbPath.
+// The old database is left alone, in case an older searmage still uses it.
+func copyLegacyDB(ctx context.Context, legacyPath, dbPath string) error {
+	unlock, err := db.LockWriter(legacyPath)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer unlock()
+
+	// copy beside dbPath first, so an interrupted copy isn't mistaken for the database
+	tmpPath := dbPath + ".tmp"
+	if err = os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "os.Remove")
+	}
+	if err = db.CopyDatabase(ctx, legacyPath, tmpPath); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrapf(os.Rename(tmpPath, dbPath), "os.Rename")
+}
 
-	err = ocr.Parse(ctx, args)
+// dhashFile returns the perceptual hash of the image file at fPath.
+func dhashFile(fPath string) (uint64, error) {
+	f, err := os.Open(fPath)
 	if err != nil {
-		slog.Error("ocr", "err", err)
+		return 0, errors.Wrapf(err, "os.Open")
 	}
+	defer f.Close()
+	dhash, err := ocr.DHash(f)
+	return dhash, errors.Wrap(err)
 }
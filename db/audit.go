@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"image"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/audit"
+)
+
+// AuditFinding is sensitive data found within an image.
+type AuditFinding struct {
+	audit.Finding
+	// Boxes are the words the finding is made of, if the image's words are stored and the finding isn't within it's codes.
+	// Images whose text was corrected by hand have none, since their words are still of the parsed text and might not line up.
+	Boxes []WordBox `json:"boxes,omitempty"`
+}
+
+// Region is the smallest rectangle containing the finding's Boxes, empty if there are none.
+func (f AuditFinding) Region() image.Rectangle {
+	var r image.Rectangle
+	for _, b := range f.Boxes {
+		r = r.Union(image.Rect(b.X0, b.Y0, b.X1, b.Y1))
+	}
+	return r
+}
+
+// AuditResult is an image containing sensitive data, found at Paths.
+type AuditResult struct {
+	ImageID  int64          `json:"image_id"`
+	Hash     string         `json:"hash"`
+	Paths    []string       `json:"paths"`
+	Findings []AuditFinding `json:"findings"`
+}
+
+// Audit scans the text and codes of every image with detectors, returning the images they found something in.
+// Corrected text is what's scanned, so findings within it don't get Boxes.
+func Audit(ctx context.Context, db *sql.DB, roots Roots, detectors []audit.Detector) ([]AuditResult, error) {
+	rows, err := db.QueryContext(ctx, `SELECT rowid, image_text, image_codes FROM images ORDER BY rowid`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	type scanned struct {
+		imageID  int64
+		text     string
+		findings []audit.Finding
+	}
+	var found []scanned
+	for rows.Next() {
+		var s scanned
+		var codes sql.NullString
+		if err = rows.Scan(&s.imageID, &s.text, &codes); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		s.text += "\n" + codes.String
+		if s.findings = audit.Scan(s.text, detectors); len(s.findings) > 0 {
+			found = append(found, s)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, errors.Wrapf(err, "rows.Close")
+	}
+
+	results := make([]AuditResult, 0, len(found))
+	for _, s := range found {
+		img, err := GetImage(ctx, db, roots, s.imageID)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		res := AuditResult{ImageID: img.ID, Hash: img.Hash, Paths: img.Paths}
+		for _, f := range s.findings {
+			finding := AuditFinding{Finding: f}
+			if img.Edit == nil {
+				finding.Boxes = matchingWords(img.Words, s.text[f.Start:f.End])
+			}
+			res.Findings = append(res.Findings, finding)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// matchingWords returns the words that make up text, by finding it within the words joined by spaces.
+// Tesseract's text and words only differ by whitespace, so a finding spanning lines still matches.
+func matchingWords(words []WordBox, text string) []WordBox {
+	needle := strings.Join(strings.Fields(text), " ")
+	if needle == "" {
+		return nil
+	}
+
+	var joined strings.Builder
+	starts := make([]int, len(words))
+	for i, w := range words {
+		if i > 0 {
+			joined.WriteByte(' ')
+		}
+		starts[i] = joined.Len()
+		joined.WriteString(w.Text)
+	}
+	start := strings.Index(joined.String(), needle)
+	if start == -1 {
+		return nil
+	}
+	end := start + len(needle)
+
+	var boxes []WordBox
+	for i, w := range words {
+		if starts[i] < end && starts[i]+len(w.Text) > start {
+			boxes = append(boxes, w)
+		}
+	}
+	return boxes
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/danlock/searmage/audit"
+)
+
+func TestAuditBoxes(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	dir := t.TempDir()
+	words := []WordBox{{Text: "card", X0: 0, Y0: 0, X1: 10, Y1: 5}, {Text: "4111111111111111", X0: 12, Y0: 0, X1: 60, Y1: 5}}
+	for _, img := range []ParsedImage{
+		{Path: filepath.Join(dir, "parsed.png"), Hash: "md5:parsed", Text: "card 4111111111111111", Words: words},
+		{Path: filepath.Join(dir, "edited.png"), Hash: "md5:edited", Text: "card 4111111111111111", Words: words},
+	} {
+		if err := InsertParsedText(ctx, db, nil, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the correction moves the card number, so the parsed words would put it's box in the wrong place
+	if err := EditText(ctx, db, hashImageID(t, ctx, db, "md5:edited"), "4111111111111111 card"); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Audit(ctx, db, nil, audit.Detectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || len(results[0].Findings) != 1 || len(results[1].Findings) != 1 {
+		t.Fatalf("got %+v, want a finding in each image", results)
+	}
+	for _, res := range results {
+		boxes := res.Findings[0].Boxes
+		switch res.Hash {
+		case "md5:parsed":
+			if len(boxes) != 1 || boxes[0] != words[1] {
+				t.Errorf("got boxes %+v for the parsed image, want %+v", boxes, words[1:])
+			}
+		case "md5:edited":
+			if len(boxes) != 0 {
+				t.Errorf("got boxes %+v for the edited image, want none", boxes)
+			}
+		}
+	}
+}
@@ -3,8 +3,13 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"math/bits"
+	"net/url"
+	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/danlock/pkg/errors"
 	"github.com/ncruces/go-sqlite3"
@@ -14,17 +19,29 @@ import (
 	"github.com/ncruces/go-sqlite3/ext/unicode"
 )
 
-func Setup(ctx context.Context, dbPath string) (*sql.DB, error) {
-	db, err := driver.Open(dbPath, func(c *sqlite3.Conn) error {
+func open(dataSourceName string) (*sql.DB, error) {
+	db, err := driver.Open(dataSourceName, func(c *sqlite3.Conn) error {
 		array.Register(c)
 		unicode.Register(c)
-		return nil
+		// hamming counts the bits that differ between two perceptual hashes
+		return c.CreateFunction("hamming", 2, sqlite3.DETERMINISTIC|sqlite3.INNOCUOUS, func(ctx sqlite3.Context, arg ...sqlite3.Value) {
+			if arg[0].Type() == sqlite3.NULL || arg[1].Type() == sqlite3.NULL {
+				ctx.ResultNull()
+				return
+			}
+			ctx.ResultInt64(int64(bits.OnesCount64(uint64(arg[0].Int64() ^ arg[1].Int64()))))
+		})
 	})
+	return db, errors.Wrapf(err, "sql.Open")
+}
+
+func Setup(ctx context.Context, dbPath string) (*sql.DB, error) {
+	db, err := open(dbPath)
 	if err != nil {
-		return nil, errors.Wrapf(err, "sql.Open")
+		return nil, errors.Wrap(err)
 	}
 
-	// the images table contains the path, our parsed text, and a hash of the image.
+	// the images table originally contained the path, our parsed text, and a hash of the image. migrations brings it up to date.
 	// image_hash is prepended with the hash algorithm (md5:, blake2b:, etc...) to support upgrading the hash later.
 	_, err = db.ExecContext(ctx, `
 		CREATE VIRTUAL TABLE IF NOT EXISTS images USING fts5(path, image_text, image_hash)`)
@@ -36,63 +53,553 @@ func Setup(ctx context.Context, dbPath string) (*sql.DB, error) {
 	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS config
 		(key TEXT PRIMARY KEY, value ANY NOT NULL) STRICT`)
-	return db, errors.Wrapf(err, "db.Exec")
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.Exec")
+	}
+
+	return db, errors.Wrap(migrate(ctx, db))
+}
+
+// SetupReadOnly opens an existing database without the ability to write to it, such as for serving searches.
+// It must already be up to date, since migrations can't be applied.
+func SetupReadOnly(ctx context.Context, dbPath string) (*sql.DB, error) {
+	absPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "filepath.Abs")
+	}
+	uriPath := filepath.ToSlash(absPath)
+	// Windows paths like C:/ still need a leading slash within a URI
+	if !strings.HasPrefix(uriPath, "/") {
+		uriPath = "/" + uriPath
+	}
+
+	db, err := open((&url.URL{Scheme: "file", Path: uriPath, RawQuery: "mode=ro"}).String())
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	var version int
+	if err = db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "PRAGMA user_version")
+	}
+	if version != len(migrations) {
+		db.Close()
+		return nil, errors.Errorf("database schema version is %d but expected %d, run another searmage command on it first to migrate it", version, len(migrations))
+	}
+	return db, nil
+}
+
+// migrations upgrade the schema of databases made by older versions of searmage. Never edit or reorder them, only append.
+// PRAGMA user_version tracks how many have been applied to a database.
+var migrations = []string{
+	// roots are named directories that image paths can be stored relative to. images.root is empty for absolute paths.
+	// FTS5 tables can't ALTER TABLE ADD COLUMN, so images is rebuilt.
+	`CREATE TABLE roots (name TEXT PRIMARY KEY, path TEXT NOT NULL) STRICT;
+	ALTER TABLE images RENAME TO images_old;
+	CREATE VIRTUAL TABLE images USING fts5(path, image_text, image_hash, root UNINDEXED);
+	INSERT INTO images (rowid, path, image_text, image_hash, root) SELECT rowid, path, image_text, image_hash, '' FROM images_old;
+	DROP TABLE images_old;`,
+	// files maps each path to the images row holding it's text. Unlike the images FTS5 table, it's indexed,
+	// so checking whether paths were parsed doesn't scan the whole table.
+	`CREATE TABLE files (
+		path TEXT NOT NULL,
+		root TEXT NOT NULL,
+		image_id INTEGER NOT NULL,
+		image_hash TEXT NOT NULL,
+		PRIMARY KEY (path, root)
+	) STRICT;
+	CREATE INDEX files_image_id ON files (image_id);
+	CREATE INDEX files_image_hash ON files (image_hash);
+	INSERT OR IGNORE INTO files (path, root, image_id, image_hash) SELECT path, root, rowid, image_hash FROM images;
+	ALTER TABLE images RENAME TO images_old;
+	CREATE VIRTUAL TABLE images USING fts5(image_text, image_hash UNINDEXED);
+	INSERT INTO images (rowid, image_text, image_hash) SELECT rowid, image_text, image_hash FROM images_old WHERE rowid IN (SELECT image_id FROM files);
+	DROP TABLE images_old;`,
+	// words holds the bounding box of every word Tesseract found within an image, in reading order.
+	`CREATE TABLE words (
+		image_id INTEGER NOT NULL,
+		word_num INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		x0 INTEGER NOT NULL,
+		y0 INTEGER NOT NULL,
+		x1 INTEGER NOT NULL,
+		y1 INTEGER NOT NULL,
+		confidence REAL NOT NULL,
+		PRIMARY KEY (image_id, word_num)
+	) STRICT;`,
+	// thumbnails are JPEGs keyed by hash, so copies of an image share one.
+	`CREATE TABLE thumbnails (image_hash TEXT PRIMARY KEY, data BLOB NOT NULL) STRICT;`,
+	// size and mod_time tell when a file changed since it was parsed. They're 0 for files parsed before they were tracked.
+	`ALTER TABLE files ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE files ADD COLUMN mod_time INTEGER NOT NULL DEFAULT 0;`,
+	// metadata is keyed by hash like thumbnails. Optional EXIF fields are empty, except the location which is NULL.
+	`CREATE TABLE metadata (
+		image_hash TEXT PRIMARY KEY,
+		format TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		taken_at TEXT NOT NULL,
+		camera_make TEXT NOT NULL,
+		camera_model TEXT NOT NULL,
+		orientation INTEGER NOT NULL,
+		latitude REAL,
+		longitude REAL
+	) STRICT;
+	CREATE INDEX metadata_taken_at ON metadata (taken_at);`,
+	// copies of an image used to be parsed separately. Now they share the images row of the first copy parsed.
+	`UPDATE files SET image_id = (SELECT MIN(f.image_id) FROM files f WHERE f.image_hash = files.image_hash);
+	DELETE FROM words WHERE image_id NOT IN (SELECT image_id FROM files);
+	DELETE FROM images WHERE rowid NOT IN (SELECT image_id FROM files);`,
+	// dhash is a 64 bit perceptual hash, NULL for images parsed before it was computed until they're read again.
+	`ALTER TABLE metadata ADD COLUMN dhash INTEGER;`,
+	// image_codes holds the QR codes and barcodes found within the image, one per line, and is NULL until it's scanned for them.
+	`ALTER TABLE images RENAME TO images_old;
+	CREATE VIRTUAL TABLE images USING fts5(image_text, image_hash UNINDEXED, image_codes);
+	INSERT INTO images (rowid, image_text, image_hash) SELECT rowid, image_text, image_hash FROM images_old;
+	DROP TABLE images_old;`,
+	// entities are typed values such as URLs and email addresses found within an image's text and codes. migrationFuncs extracts them from images parsed before.
+	`CREATE TABLE entities (
+		image_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (image_id, type, value)
+	) STRICT;
+	CREATE INDEX entities_type_value ON entities (type, value);`,
+	// tags and notes are added by users, keyed by hash like thumbnails. image_tags and image_note copy them into images so searches match them.
+	`CREATE TABLE tags (image_hash TEXT NOT NULL, tag TEXT NOT NULL COLLATE NOCASE, PRIMARY KEY (image_hash, tag)) STRICT;
+	CREATE INDEX tags_tag ON tags (tag);
+	CREATE TABLE notes (image_hash TEXT PRIMARY KEY, note TEXT NOT NULL) STRICT;
+	ALTER TABLE images RENAME TO images_old;
+	CREATE VIRTUAL TABLE images USING fts5(image_text, image_hash UNINDEXED, image_codes, image_tags, image_note);
+	INSERT INTO images (rowid, image_text, image_hash, image_codes) SELECT rowid, image_text, image_hash, image_codes FROM images_old;
+	DROP TABLE images_old;`,
+	// edits keeps the text Tesseract parsed for images whose text was corrected by hand. edited_at is in Unix nanoseconds.
+	`CREATE TABLE edits (image_id INTEGER PRIMARY KEY, original_text TEXT NOT NULL, edited_at INTEGER NOT NULL) STRICT;`,
+	// indexed_at is when a path was last indexed as a different image than before, in Unix nanoseconds, or 0 for paths indexed before it was tracked.
+	// saved_searches are named searches, checked for images indexed after checked_at.
+	`ALTER TABLE files ADD COLUMN indexed_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX files_indexed_at ON files (indexed_at);
+	CREATE TABLE saved_searches (name TEXT PRIMARY KEY, text TEXT NOT NULL, mode TEXT NOT NULL, checked_at INTEGER NOT NULL) STRICT;`,
+}
+
+// migrationFuncs run after the migration at the same index within it's transaction, for what SQL alone can't do.
+var migrationFuncs = map[int]func(context.Context, *sql.Tx) error{
+	9: extractAllEntities,
 }
 
-func FilterParsedImages(ctx context.Context, db *sql.DB, images []string) ([]string, error) {
+func migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return errors.Wrapf(err, "PRAGMA user_version")
+	}
+	if version > len(migrations) {
+		return errors.Errorf("database schema version %d is newer than this searmage supports (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := applyMigration(ctx, db, version); err != nil {
+			return errors.Wrapf(err, "migration %d", version+1)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, migrations[version]); err != nil {
+		return errors.Wrapf(err, "tx.ExecContext")
+	}
+	if f := migrationFuncs[version]; f != nil {
+		if err = f(ctx, tx); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	// PRAGMAs can't take parameters
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+		return errors.Wrapf(err, "PRAGMA user_version")
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// ImageFile is an image that may need parsing, along with what tells whether it changed since it was parsed.
+// Path may be an entry within an archive, in which case Size and ModTime are the entry's.
+type ImageFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// modTime stores t as Unix nanoseconds, with 0 for an unknown time.
+func modTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// FilterParsedImages returns the images that weren't parsed yet, or changed size or modification time since they were.
+// Images parsed before their metadata and perceptual hash were stored are returned too, to be read again without being OCRed, see InsertDuplicate.
+// So are images that weren't scanned for QR codes and barcodes yet, if scanCodes is set.
+// Changed files whose text was edited by hand are left alone, so the correction isn't lost, unless overwriteEdits is set.
+// Files parsed before their size and modification time were tracked are assumed unchanged, and have them recorded now.
+func FilterParsedImages(ctx context.Context, db *sql.DB, roots Roots, images []ImageFile, scanCodes, overwriteEdits bool) ([]ImageFile, error) {
 	// TODO: For now we use the path to identify images. Eventually incorporate the hash to recognize an image after renames.
+	relPaths := make([]string, len(images))
+	for i, img := range images {
+		_, relPaths[i] = roots.Split(img.Path)
+	}
+
 	rows, err := db.QueryContext(ctx, `
-		SELECT path FROM images WHERE path IN array(?)
-	`, sqlite3.Pointer(images))
+		SELECT root, path, size, mod_time,
+			EXISTS (SELECT 1 FROM metadata m WHERE m.image_hash = files.image_hash AND m.dhash IS NOT NULL),
+			(SELECT image_codes IS NULL FROM images WHERE rowid = files.image_id),
+			EXISTS (SELECT 1 FROM edits WHERE edits.image_id = files.image_id)
+		FROM files WHERE path IN array(?)
+	`, sqlite3.Pointer(relPaths))
 	if err != nil {
 		return images, errors.Wrapf(err, "db.QueryContext")
 	}
 	defer rows.Close()
 
-	parsedImages := make(map[string]struct{})
+	type parsed struct {
+		size, modTime int64
+		hasDHash      bool
+		unscanned     bool
+		edited        bool
+	}
+	parsedImages := make(map[string]parsed)
 
 	for rows.Next() {
-		var path string
-		if err = rows.Scan(&path); err != nil {
+		var root, path string
+		var p parsed
+		if err = rows.Scan(&root, &path, &p.size, &p.modTime, &p.hasDHash, &p.unscanned, &p.edited); err != nil {
 			return images, errors.Wrapf(err, "rows.Scan")
 		}
-		parsedImages[path] = struct{}{}
+		parsedImages[roots.Join(root, path)] = p
+	}
+	if err = rows.Err(); err != nil {
+		return images, errors.Wrapf(err, "rows.Err")
 	}
 
-	return slices.DeleteFunc(images, func(s string) bool {
-		_, wasParsed := parsedImages[s]
-		return wasParsed
-	}), nil
+	var untracked []ImageFile
+	unparsed := slices.DeleteFunc(images, func(img ImageFile) bool {
+		p, wasParsed := parsedImages[roots.Join(roots.Split(img.Path))]
+		if !wasParsed {
+			return false
+		}
+		isUntracked := p.size == 0 && p.modTime == 0
+		changed := !isUntracked && (p.size != img.Size || p.modTime != modTime(img.ModTime))
+		if changed && p.edited && !overwriteEdits {
+			return true
+		}
+		if !p.hasDHash || scanCodes && p.unscanned {
+			return false
+		}
+		if isUntracked {
+			untracked = append(untracked, img)
+			return true
+		}
+		return !changed
+	})
+	return unparsed, errors.Wrap(trackFiles(ctx, db, roots, untracked))
 }
 
-func InsertParsedText(ctx context.Context, db *sql.DB, path, text, hash string) error {
-	_, err := db.ExecContext(ctx, `
-		INSERT INTO images (path, image_text, image_hash) VALUES (?,?,?)
-	`, path, text, hash)
-	return errors.Wrap(err)
+// trackFiles records the size and modification time of files parsed before they were tracked.
+func trackFiles(ctx context.Context, db *sql.DB, roots Roots, images []ImageFile) error {
+	if len(images) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	for _, img := range images {
+		root, path := roots.Split(img.Path)
+		_, err = tx.ExecContext(ctx, `UPDATE files SET size = ?, mod_time = ? WHERE path = ? AND root = ?`,
+			img.Size, modTime(img.ModTime), path, root)
+		if err != nil {
+			return errors.Wrapf(err, "UPDATE files")
+		}
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// WordBox is a word Tesseract found within an image, and the pixel coordinates of it's bounding box.
+type WordBox struct {
+	Text       string  `json:"text"`
+	X0         int     `json:"x0"`
+	Y0         int     `json:"y0"`
+	X1         int     `json:"x1"`
+	Y1         int     `json:"y1"`
+	Confidence float64 `json:"confidence"`
+}
+
+// ParsedImage is the result of parsing the image at Path.
+type ParsedImage struct {
+	Path string
+	// Size and ModTime are the file's when it was parsed, if known.
+	Size    int64
+	ModTime time.Time
+	Hash    string
+	Text    string
+	Words   []WordBox
+	// Thumbnail and Metadata are stored for Hash if set, otherwise anything stored already is kept.
+	Thumbnail []byte
+	Metadata  *Metadata
+	// Codes are the QR codes and barcodes within the image, nil if it wasn't scanned for them, in which case any stored already are kept.
+	Codes []string
+}
+
+// InsertParsedText stores the text and words of the image, with it's path relative to it's Root if it has one.
+func InsertParsedText(ctx context.Context, db *sql.DB, roots Roots, img ParsedImage) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	if err = insertImage(ctx, tx, roots, img); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
 }
 
-func SearchParsedText(ctx context.Context, db *sql.DB, search string, isRegex bool) ([]string, error) {
-	searchQ := "SELECT path FROM images WHERE image_text MATCH ?"
-	if isRegex {
-		searchQ = strings.Replace(searchQ, "MATCH", "REGEXP", 1)
+// insertImage adds an images row with the text, and points the files row for path at it.
+// If a copy of the image was already parsed, the path shares it's images row instead, so each hash's text is only stored once.
+// Whatever the path pointed at before is deleted if nothing else uses it.
+func insertImage(ctx context.Context, tx *sql.Tx, roots Roots, img ParsedImage) error {
+	if err := insertHashData(ctx, tx, img); err != nil {
+		return errors.Wrap(err)
 	}
 
-	rows, err := db.QueryContext(ctx, searchQ, search)
+	imageID, err := imageIDForHash(ctx, tx, img.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		res, err := tx.ExecContext(ctx, `INSERT INTO images (image_text, image_hash, image_codes) VALUES (?,?,?)`, img.Text, img.Hash, joinCodes(img.Codes))
+		if err != nil {
+			return errors.Wrapf(err, "INSERT images")
+		}
+		if imageID, err = res.LastInsertId(); err != nil {
+			return errors.Wrapf(err, "res.LastInsertId")
+		}
+		if err = insertWords(ctx, tx, imageID, img.Words); err != nil {
+			return errors.Wrap(err)
+		}
+		if err = extractEntities(ctx, tx, imageID); err != nil {
+			return errors.Wrap(err)
+		}
+	} else if err != nil {
+		return errors.Wrap(err)
+	} else if err = updateCodes(ctx, tx, imageID, img.Codes); err != nil {
+		return errors.Wrap(err)
+	}
+	if err = linkFile(ctx, tx, roots, img, imageID); err != nil {
+		return errors.Wrap(err)
+	}
+	// the hash may have tags and a note from before it was pruned
+	return errors.Wrap(updateTagText(ctx, tx, img.Hash))
+}
+
+// InsertDuplicate points the files row for img's path at the text already stored for img.Hash, so copies of an image are only parsed once.
+// It's thumbnail, metadata and codes are stored if set. It returns false without changing anything if no image with the hash was parsed yet.
+func InsertDuplicate(ctx context.Context, db *sql.DB, roots Roots, img ParsedImage) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	imageID, err := imageIDForHash(ctx, tx, img.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err)
+	}
+	if err = insertHashData(ctx, tx, img); err != nil {
+		return false, errors.Wrap(err)
+	}
+	if err = updateCodes(ctx, tx, imageID, img.Codes); err != nil {
+		return false, errors.Wrap(err)
+	}
+	if err = linkFile(ctx, tx, roots, img, imageID); err != nil {
+		return false, errors.Wrap(err)
+	}
+	return true, errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// updateCodes replaces the codes stored for the image and the entities within them, unless codes is nil.
+func updateCodes(ctx context.Context, tx *sql.Tx, imageID int64, codes []string) error {
+	if codes == nil {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE images SET image_codes = ? WHERE rowid = ?`, joinCodes(codes), imageID); err != nil {
+		return errors.Wrapf(err, "UPDATE images")
+	}
+	return errors.Wrap(extractEntities(ctx, tx, imageID))
+}
+
+// joinCodes stores codes one per line, with line breaks and other whitespace within them collapsed into single spaces. Nil codes are stored as NULL.
+func joinCodes(codes []string) any {
+	if codes == nil {
+		return nil
+	}
+	lines := make([]string, len(codes))
+	for i, c := range codes {
+		lines[i] = strings.Join(strings.Fields(c), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// splitCodes reads codes stored by joinCodes.
+func splitCodes(codes sql.NullString) []string {
+	if codes.String == "" {
+		return nil
+	}
+	return strings.Split(codes.String, "\n")
+}
+
+// insertHashData stores the thumbnail and metadata of img's hash, if set.
+func insertHashData(ctx context.Context, tx *sql.Tx, img ParsedImage) error {
+	if img.Thumbnail != nil {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO thumbnails (image_hash, data) VALUES (?,?)
+			ON CONFLICT (image_hash) DO UPDATE SET data = excluded.data
+		`, img.Hash, img.Thumbnail)
+		if err != nil {
+			return errors.Wrapf(err, "INSERT thumbnails")
+		}
+	}
+	if img.Metadata != nil {
+		return errors.Wrap(insertMetadata(ctx, tx, img.Hash, *img.Metadata))
+	}
+	return nil
+}
+
+// imageIDForHash returns the images row holding the text of the hash. The error wraps sql.ErrNoRows if there is none.
+func imageIDForHash(ctx context.Context, tx *sql.Tx, hash string) (imageID int64, err error) {
+	err = tx.QueryRowContext(ctx, `SELECT image_id FROM files WHERE image_hash = ? LIMIT 1`, hash).Scan(&imageID)
+	return imageID, errors.Wrapf(err, "SELECT files")
+}
+
+// linkFile points the files row for img's path at imageID, deleting the images row, thumbnail and metadata it pointed at before if nothing else uses them.
+func linkFile(ctx context.Context, tx *sql.Tx, roots Roots, img ParsedImage, imageID int64) error {
+	root, path := roots.Split(img.Path)
+
+	old := fileRow{root: root, path: path}
+	err := tx.QueryRowContext(ctx, `SELECT image_id, image_hash FROM files WHERE path = ? AND root = ?`, path, root).Scan(&old.imageID, &old.hash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrapf(err, "SELECT files")
+	}
+
+	// a path linked to the same image again, such as after it's modification time changed, isn't newly indexed
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO files (path, root, image_id, image_hash, size, mod_time, indexed_at) VALUES (?,?,?,?,?,?,?)
+		ON CONFLICT (path, root) DO UPDATE SET image_id = excluded.image_id, image_hash = excluded.image_hash,
+			size = excluded.size, mod_time = excluded.mod_time,
+			indexed_at = iif(files.image_hash = excluded.image_hash, files.indexed_at, excluded.indexed_at)
+	`, path, root, imageID, img.Hash, img.Size, modTime(img.ModTime), modTime(time.Now()))
+	if err != nil {
+		return errors.Wrapf(err, "INSERT files")
+	}
+
+	if old.hash == "" {
+		return nil
+	}
+	if old.imageID != imageID {
+		if err = deleteUnusedImage(ctx, tx, old.imageID); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	if old.hash != img.Hash {
+		return errors.Wrap(deleteUnusedHash(ctx, tx, old.hash))
+	}
+	return nil
+}
+
+// deleteUnusedImage deletes an images row, it's words, entities and edit if no files point at it anymore.
+func deleteUnusedImage(ctx context.Context, tx *sql.Tx, imageID int64) error {
+	var used bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM files WHERE image_id = ?)`, imageID).Scan(&used)
+	if err != nil {
+		return errors.Wrapf(err, "SELECT files")
+	}
+	if used {
+		return nil
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM words WHERE image_id = ?`, imageID); err != nil {
+		return errors.Wrapf(err, "DELETE words")
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM entities WHERE image_id = ?`, imageID); err != nil {
+		return errors.Wrapf(err, "DELETE entities")
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM edits WHERE image_id = ?`, imageID); err != nil {
+		return errors.Wrapf(err, "DELETE edits")
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM images WHERE rowid = ?`, imageID)
+	return errors.Wrapf(err, "DELETE images")
+}
+
+// insertWords replaces the words of an image.
+func insertWords(ctx context.Context, tx *sql.Tx, imageID int64, words []WordBox) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM words WHERE image_id = ?`, imageID); err != nil {
+		return errors.Wrapf(err, "DELETE words")
+	}
+	if len(words) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO words (image_id, word_num, text, x0, y0, x1, y1, confidence) VALUES (?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return errors.Wrapf(err, "tx.PrepareContext")
+	}
+	defer stmt.Close()
+
+	for i, w := range words {
+		if _, err = stmt.ExecContext(ctx, imageID, i, w.Text, w.X0, w.Y0, w.X1, w.Y1, w.Confidence); err != nil {
+			return errors.Wrapf(err, "INSERT words")
+		}
+	}
+	return nil
+}
+
+// getWords returns the words of an image in reading order.
+func getWords(ctx context.Context, db *sql.DB, imageID int64) ([]WordBox, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT text, x0, y0, x1, y1, confidence FROM words WHERE image_id = ? ORDER BY word_num`, imageID)
 	if err != nil {
 		return nil, errors.Wrapf(err, "db.QueryContext")
 	}
 	defer rows.Close()
 
-	var matchingImages []string
-
+	var words []WordBox
 	for rows.Next() {
-		var path string
-		if err = rows.Scan(&path); err != nil {
+		var w WordBox
+		if err = rows.Scan(&w.Text, &w.X0, &w.Y0, &w.X1, &w.Y1, &w.Confidence); err != nil {
 			return nil, errors.Wrapf(err, "rows.Scan")
 		}
-		matchingImages = append(matchingImages, path)
+		words = append(words, w)
 	}
+	return words, errors.Wrapf(rows.Err(), "rows.Err")
+}
 
+// SearchParsedText returns the paths of images matching q, resolved against their Root's current location.
+func SearchParsedText(ctx context.Context, db *sql.DB, roots Roots, q Query) ([]string, error) {
+	results, _, err := Search(ctx, db, roots, q)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	matchingImages := make([]string, len(results))
+	for i, r := range results {
+		matchingImages[i] = r.Path
+	}
 	return matchingImages, nil
 }
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDB returns a new database within a temporary directory, which is removed after the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := Setup(context.Background(), filepath.Join(t.TempDir(), "searmage.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// writeImage writes a file to stand in for an image at path, since only Prune and Rehash read them.
+func writeImage(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
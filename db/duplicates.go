@@ -0,0 +1,60 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// DuplicateGroup is an image found at more than one path.
+type DuplicateGroup struct {
+	ImageID int64  `json:"image_id"`
+	Hash    string `json:"hash"`
+	// Size is the size of a single copy in bytes, or 0 if the copies were parsed before their size was tracked.
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths"`
+}
+
+// Wasted is how many bytes the extra copies take up.
+func (g DuplicateGroup) Wasted() int64 {
+	return g.Size * int64(len(g.Paths)-1)
+}
+
+// Duplicates returns every image found at more than one path, with the paths resolved against roots.
+// The groups wasting the most space come first.
+func Duplicates(ctx context.Context, db *sql.DB, roots Roots) ([]DuplicateGroup, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT image_id, image_hash, root, path, size FROM files
+		WHERE image_id IN (SELECT image_id FROM files GROUP BY image_id HAVING COUNT(*) > 1)
+		ORDER BY image_id, root, path`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var groups []DuplicateGroup
+	for rows.Next() {
+		var imageID, size int64
+		var hash, root, path string
+		if err = rows.Scan(&imageID, &hash, &root, &path, &size); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ImageID != imageID {
+			groups = append(groups, DuplicateGroup{ImageID: imageID, Hash: hash})
+		}
+		g := &groups[len(groups)-1]
+		g.Size = max(g.Size, size)
+		g.Paths = append(g.Paths, roots.Join(root, path))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "rows.Err")
+	}
+
+	slices.SortStableFunc(groups, func(a, b DuplicateGroup) int {
+		return cmp.Compare(b.Wasted(), a.Wasted())
+	})
+	return groups, nil
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/hashing"
+)
+
+// Edit records that an image's text was corrected by hand, keeping the text Tesseract parsed.
+// Images with an Edit aren't parsed again when their file changes, unless asked to overwrite edits.
+type Edit struct {
+	OriginalText string    `json:"original_text"`
+	EditedAt     time.Time `json:"edited_at"`
+}
+
+// FindImage returns the id and hash of the image indexed at path, found like ImageHash.
+func FindImage(ctx context.Context, db *sql.DB, roots Roots, path string, alg hashing.Algorithm) (imageID int64, hash string, err error) {
+	if hash, err = ImageHash(ctx, db, roots, path, alg); err != nil {
+		return 0, "", errors.Wrap(err)
+	}
+	err = db.QueryRowContext(ctx, `SELECT image_id FROM files WHERE image_hash = ? LIMIT 1`, hash).Scan(&imageID)
+	return imageID, hash, errors.Wrapf(err, "SELECT files")
+}
+
+// EditText replaces the text of the image with a correction, keeping the original text if it was already edited.
+// The error wraps sql.ErrNoRows if there is no such image.
+func EditText(ctx context.Context, db *sql.DB, imageID int64, text string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	var original string
+	if err = tx.QueryRowContext(ctx, `SELECT image_text FROM images WHERE rowid = ?`, imageID).Scan(&original); err != nil {
+		return errors.Wrapf(err, "SELECT images")
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO edits (image_id, original_text, edited_at) VALUES (?,?,?)
+		ON CONFLICT (image_id) DO UPDATE SET edited_at = excluded.edited_at
+	`, imageID, original, modTime(time.Now()))
+	if err != nil {
+		return errors.Wrapf(err, "INSERT edits")
+	}
+	if err = setText(ctx, tx, imageID, text); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// RevertEdit restores the text Tesseract parsed for the image, if it was edited.
+func RevertEdit(ctx context.Context, db *sql.DB, imageID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	var original string
+	err = tx.QueryRowContext(ctx, `DELETE FROM edits WHERE image_id = ? RETURNING original_text`, imageID).Scan(&original)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "DELETE edits")
+	}
+	if err = setText(ctx, tx, imageID, original); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// setText replaces the text of the image, along with the entities found within it.
+func setText(ctx context.Context, tx *sql.Tx, imageID int64, text string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE images SET image_text = ? WHERE rowid = ?`, text, imageID); err != nil {
+		return errors.Wrapf(err, "UPDATE images")
+	}
+	return errors.Wrap(extractEntities(ctx, tx, imageID))
+}
+
+// moveEdit carries the corrected text of an image over to the image it's being merged into, unless that one was corrected too.
+func moveEdit(ctx context.Context, tx *sql.Tx, fromID, toID int64) error {
+	var text string
+	err := tx.QueryRowContext(ctx, `
+		SELECT image_text FROM images
+		WHERE rowid = ?1 AND rowid IN (SELECT image_id FROM edits) AND ?2 NOT IN (SELECT image_id FROM edits)
+	`, fromID, toID).Scan(&text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "SELECT images")
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE edits SET image_id = ? WHERE image_id = ?`, toID, fromID); err != nil {
+		return errors.Wrapf(err, "UPDATE edits")
+	}
+	return errors.Wrap(setText(ctx, tx, toID, text))
+}
+
+// insertEdit stores edit for the image, replacing any it had.
+func insertEdit(ctx context.Context, tx *sql.Tx, imageID int64, edit Edit) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO edits (image_id, original_text, edited_at) VALUES (?,?,?)
+		ON CONFLICT (image_id) DO UPDATE SET original_text = excluded.original_text, edited_at = excluded.edited_at
+	`, imageID, edit.OriginalText, modTime(edit.EditedAt))
+	return errors.Wrapf(err, "INSERT edits")
+}
+
+// getEdit returns the image's Edit, or nil if it's text wasn't edited.
+func getEdit(ctx context.Context, db *sql.DB, imageID int64) (*Edit, error) {
+	var edit Edit
+	var editedAt int64
+	err := db.QueryRowContext(ctx, `SELECT original_text, edited_at FROM edits WHERE image_id = ?`, imageID).Scan(&edit.OriginalText, &editedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "SELECT edits")
+	}
+	edit.EditedAt = time.Unix(0, editedAt)
+	return &edit, nil
+}
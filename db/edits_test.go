@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/danlock/searmage/hashing"
+)
+
+// hashImageID returns the id of the image indexed with hash.
+func hashImageID(t *testing.T, ctx context.Context, db *sql.DB, hash string) int64 {
+	t.Helper()
+	var id int64
+	if err := db.QueryRowContext(ctx, `SELECT image_id FROM files WHERE image_hash = ?`, hash).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// checkEdit fails the test unless the image with hash has the corrected text, still knowing the original.
+func checkEdit(t *testing.T, ctx context.Context, db *sql.DB, hash, wantText, wantOriginal string) Image {
+	t.Helper()
+	img, err := GetImage(ctx, db, nil, hashImageID(t, ctx, db, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Text != wantText || img.Edit == nil || img.Edit.OriginalText != wantOriginal {
+		t.Fatalf("got text %q and edit %+v, want %q corrected from %q", img.Text, img.Edit, wantText, wantOriginal)
+	}
+	return img
+}
+
+func TestRehashKeepsEdit(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	dir := t.TempDir()
+	path, copyPath := filepath.Join(dir, "receipt.png"), filepath.Join(dir, "copy.png")
+	writeImage(t, path, "receipt")
+	writeImage(t, copyPath, "receipt")
+	newHash, err := hashing.Sum(hashing.XXHash, strings.NewReader("receipt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = InsertParsedText(ctx, db, nil, ParsedImage{Path: path, Hash: "md5:receipt", Text: "tota1 42"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = InsertParsedText(ctx, db, nil, ParsedImage{Path: copyPath, Hash: newHash, Text: "tota1 42"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = EditText(ctx, db, hashImageID(t, ctx, db, "md5:receipt"), "total 42"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the edited image is merged into the copy, which was already hashed with xxhash
+	report, err := Rehash(ctx, db, nil, hashing.XXHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Merged != 1 {
+		t.Fatalf("got %+v, want 1 merged", report)
+	}
+	img := checkEdit(t, ctx, db, newHash, "total 42", "tota1 42")
+	if len(img.Paths) != 2 {
+		t.Fatalf("got paths %v, want both copies", img.Paths)
+	}
+	results, _, err := Search(ctx, db, nil, Query{Text: "total"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("searching the corrected text got %+v", results)
+	}
+}
+
+func TestImportKeepsEdit(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	path := filepath.Join(t.TempDir(), "receipt.png")
+	words := []WordBox{{Text: "tota1", X0: 1, Y0: 1, X1: 10, Y1: 5, Confidence: 60}, {Text: "42", X0: 12, Y0: 1, X1: 16, Y1: 5, Confidence: 90}}
+	err := InsertParsedText(ctx, db, nil, ParsedImage{Path: path, Hash: "md5:receipt", Text: "tota1 42", Words: words})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = EditText(ctx, db, hashImageID(t, ctx, db, "md5:receipt"), "total 42"); err != nil {
+		t.Fatal(err)
+	}
+
+	// another machine parsed the image again without correcting it
+	reparsed := `{"path":"` + path + `","hash":"md5:receipt","text":"tota! 4Z","words":[{"text":"tota!","x0":1,"y0":1,"x1":10,"y1":5,"confidence":40}]}`
+	if _, err = Import(ctx, db, nil, strings.NewReader(reparsed), nil); err != nil {
+		t.Fatal(err)
+	}
+	img := checkEdit(t, ctx, db, "md5:receipt", "total 42", "tota1 42")
+	if !slices.Equal(img.Words, words) {
+		t.Fatalf("got words %+v, want the ones the correction was made from", img.Words)
+	}
+
+	// but a correction made elsewhere replaces ours
+	corrected := `{"path":"` + path + `","hash":"md5:receipt","text":"total 42.00","words":[{"text":"tota!","x0":1,"y0":1,"x1":10,"y1":5,"confidence":40}],"edit":{"original_text":"tota! 4Z","edited_at":"2024-06-01T00:00:00Z"}}`
+	if _, err = Import(ctx, db, nil, strings.NewReader(corrected), nil); err != nil {
+		t.Fatal(err)
+	}
+	img = checkEdit(t, ctx, db, "md5:receipt", "total 42.00", "tota! 4Z")
+	if len(img.Words) != 1 || img.Words[0].Text != "tota!" {
+		t.Fatalf("got words %+v, want the imported ones", img.Words)
+	}
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/entities"
+)
+
+// EntityResult is an entity found within the text or codes of the images at Paths.
+type EntityResult struct {
+	Type  entities.Type `json:"type"`
+	Value string        `json:"value"`
+	Paths []string      `json:"paths"`
+}
+
+// Entities returns the entities of type typ, or of every type if it's empty, found within the images matching q.
+// Only q.Text, which is matched like SearchMatch, Root and PathPrefix are used. Entities are ordered by type and value.
+func Entities(ctx context.Context, db *sql.DB, roots Roots, typ entities.Type, q Query) ([]EntityResult, error) {
+	where, args := pathFilters(roots, q, "f")
+	if typ != "" {
+		where, args = append(where, "e.type = ?"), append(args, typ)
+	}
+	if q.Text != "" {
+		where, args = append(where, "e.image_id IN (SELECT rowid FROM images WHERE images MATCH ?)"), append(args, q.Text)
+	}
+	whereSQL := "TRUE"
+	if len(where) > 0 {
+		whereSQL = strings.Join(where, " AND ")
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.type, e.value, f.root, f.path FROM entities e JOIN files f ON f.image_id = e.image_id
+		WHERE `+whereSQL+`
+		ORDER BY e.type, e.value, f.root, f.path`, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var results []EntityResult
+	for rows.Next() {
+		var e EntityResult
+		var root, path string
+		if err = rows.Scan(&e.Type, &e.Value, &root, &path); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		if len(results) == 0 || results[len(results)-1].Type != e.Type || results[len(results)-1].Value != e.Value {
+			results = append(results, e)
+		}
+		last := &results[len(results)-1]
+		last.Paths = append(last.Paths, roots.Join(root, path))
+	}
+	return results, errors.Wrapf(rows.Err(), "rows.Err")
+}
+
+// extractEntities replaces the entities of an image with the ones found in it's text and codes.
+func extractEntities(ctx context.Context, tx *sql.Tx, imageID int64) error {
+	var text string
+	var codes sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT image_text, image_codes FROM images WHERE rowid = ?`, imageID).Scan(&text, &codes)
+	if err != nil {
+		return errors.Wrapf(err, "SELECT images")
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM entities WHERE image_id = ?`, imageID); err != nil {
+		return errors.Wrapf(err, "DELETE entities")
+	}
+
+	found := entities.Extract(text + "\n" + codes.String)
+	if len(found) == 0 {
+		return nil
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO entities (image_id, type, value) VALUES (?,?,?)`)
+	if err != nil {
+		return errors.Wrapf(err, "tx.PrepareContext")
+	}
+	defer stmt.Close()
+	for _, e := range found {
+		if _, err = stmt.ExecContext(ctx, imageID, e.Type, e.Value); err != nil {
+			return errors.Wrapf(err, "INSERT entities")
+		}
+	}
+	return nil
+}
+
+// extractAllEntities fills in the entities of images parsed before they were extracted.
+func extractAllEntities(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT rowid FROM images`)
+	if err != nil {
+		return errors.Wrapf(err, "tx.QueryContext")
+	}
+	var imageIDs []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "rows.Scan")
+		}
+		imageIDs = append(imageIDs, id)
+	}
+	if err = rows.Close(); err != nil {
+		return errors.Wrapf(err, "rows.Close")
+	}
+
+	for _, id := range imageIDs {
+		if err = extractEntities(ctx, tx, id); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// ExportedImage is a single line of the JSON Lines format written by Export and read by Import.
+type ExportedImage struct {
+	Path     string    `json:"path"`
+	Hash     string    `json:"hash"`
+	Text     string    `json:"text"`
+	Words    []WordBox `json:"words,omitempty"`
+	Codes    []string  `json:"codes,omitempty"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	Note     string    `json:"note,omitempty"`
+	// Edit is set if Text was corrected by hand.
+	Edit *Edit `json:"edit,omitempty"`
+}
+
+// Export writes every indexed image to w as JSON Lines, one ExportedImage per line.
+// Paths are resolved against roots, so the export is usable without them.
+// Words and tags are aggregated into JSON arrays within the query, so it's a single query however many images there are.
+func Export(ctx context.Context, db *sql.DB, roots Roots, w io.Writer) (count int, err error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.root, f.path, f.image_hash, i.image_text, i.image_codes,
+			(SELECT '[' || coalesce(group_concat(json_object('text', text, 'x0', x0, 'y0', y0, 'x1', x1, 'y1', y1, 'confidence', confidence), ',' ORDER BY word_num), '') || ']'
+				FROM words WHERE image_id = f.image_id),
+			(SELECT json_group_array(tag ORDER BY tag) FROM tags WHERE image_hash = f.image_hash),
+			coalesce(n.note, ''), e.original_text, e.edited_at, `+metadataColumns+`
+		FROM files f JOIN images i ON i.rowid = f.image_id LEFT JOIN metadata m ON m.image_hash = f.image_hash
+		LEFT JOIN notes n ON n.image_hash = f.image_hash LEFT JOIN edits e ON e.image_id = f.image_id
+		ORDER BY f.root, f.path`)
+	if err != nil {
+		return 0, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var img ExportedImage
+		var root, words, tags string
+		var codes, originalText sql.NullString
+		var editedAt sql.NullInt64
+		var md metadataScanner
+		dest := []any{&root, &img.Path, &img.Hash, &img.Text, &codes, &words, &tags, &img.Note, &originalText, &editedAt}
+		if err = rows.Scan(append(dest, md.dest()...)...); err != nil {
+			return count, errors.Wrapf(err, "rows.Scan")
+		}
+		img.Path, img.Codes, img.Metadata = roots.Join(root, img.Path), splitCodes(codes), md.metadata()
+		if err = json.Unmarshal([]byte(words), &img.Words); err != nil {
+			return count, errors.Wrapf(err, "json.Unmarshal words")
+		}
+		if err = json.Unmarshal([]byte(tags), &img.Tags); err != nil {
+			return count, errors.Wrapf(err, "json.Unmarshal tags")
+		}
+		if originalText.Valid {
+			img.Edit = &Edit{OriginalText: originalText.String, EditedAt: time.Unix(0, editedAt.Int64)}
+		}
+		if err = enc.Encode(img); err != nil {
+			return count, errors.Wrapf(err, "enc.Encode")
+		}
+		count++
+	}
+	return count, errors.Wrapf(rows.Err(), "rows.Err")
+}
+
+// ImportReport counts what Import did with each ExportedImage it read.
+type ImportReport struct {
+	Inserted int
+	Updated  int
+}
+
+// Import reads JSON Lines of ExportedImage from r into the database within a single transaction, upserting by hash.
+// The text (and words, codes and metadata, if any) of every path already indexed with the same hash is replaced, and the path is added, replacing it's old text if it was indexed with a different hash.
+// Tags are added to the ones the hash already has, and the note replaces it's note if set.
+// Text corrected by hand, and the words parsed from it's original text, are only replaced by an import that was corrected too.
+// rewritePath, if set, is applied to every imported path, such as to swap the prefix of another machine's image directory for ours.
+// Afterwards paths within roots are stored relative to them, just like InsertParsedText.
+func Import(ctx context.Context, db *sql.DB, roots Roots, r io.Reader, rewritePath func(string) string) (report ImportReport, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var img ExportedImage
+		if err = dec.Decode(&img); err == io.EOF {
+			break
+		} else if err != nil {
+			return report, errors.Wrapf(err, "dec.Decode line %d", line)
+		}
+		if img.Path == "" || img.Hash == "" {
+			return report, errors.Errorf("line %d is missing a path or hash", line)
+		}
+		if rewritePath != nil {
+			img.Path = rewritePath(img.Path)
+		}
+
+		// FTS5 tables don't support UPDATE RETURNING, so find the rows before updating them
+		rows, err := tx.QueryContext(ctx, `SELECT DISTINCT image_id FROM files WHERE image_hash = ?`, img.Hash)
+		if err != nil {
+			return report, errors.Wrapf(err, "SELECT files line %d", line)
+		}
+		var updatedIDs []int64
+		for rows.Next() {
+			var id int64
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return report, errors.Wrapf(err, "rows.Scan line %d", line)
+			}
+			updatedIDs = append(updatedIDs, id)
+		}
+		if err = rows.Close(); err != nil {
+			return report, errors.Wrapf(err, "SELECT files line %d", line)
+		}
+		// text corrected by hand is kept, along with the words of the text it corrected
+		var editedIDs []int64
+		for _, id := range updatedIDs {
+			var edited bool
+			err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM edits WHERE image_id = ?)`, id).Scan(&edited)
+			if err != nil {
+				return report, errors.Wrapf(err, "SELECT edits line %d", line)
+			}
+			if edited && img.Edit == nil {
+				editedIDs = append(editedIDs, id)
+				continue
+			}
+			if _, err = tx.ExecContext(ctx, `UPDATE images SET image_text = ? WHERE rowid = ?`, img.Text, id); err != nil {
+				return report, errors.Wrapf(err, "UPDATE images line %d", line)
+			}
+		}
+		if len(updatedIDs) > 0 {
+			report.Updated++
+		}
+		if img.Metadata != nil {
+			if err = insertMetadata(ctx, tx, img.Hash, *img.Metadata); err != nil {
+				return report, errors.Wrapf(err, "line %d", line)
+			}
+		}
+		for _, id := range updatedIDs {
+			if len(img.Words) > 0 && !slices.Contains(editedIDs, id) {
+				if err = insertWords(ctx, tx, id, img.Words); err != nil {
+					return report, errors.Wrapf(err, "line %d", line)
+				}
+			}
+			if err = updateCodes(ctx, tx, id, img.Codes); err != nil {
+				return report, errors.Wrapf(err, "line %d", line)
+			}
+			if err = extractEntities(ctx, tx, id); err != nil {
+				return report, errors.Wrapf(err, "line %d", line)
+			}
+		}
+
+		root, relPath := roots.Split(img.Path)
+		var existingHash string
+		err = tx.QueryRowContext(ctx, `SELECT image_hash FROM files WHERE path = ? AND root = ?`, relPath, root).Scan(&existingHash)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return report, errors.Wrapf(err, "SELECT files line %d", line)
+		}
+		if existingHash != img.Hash {
+			if err = insertImage(ctx, tx, roots, ParsedImage{Path: img.Path, Hash: img.Hash, Text: img.Text, Words: img.Words, Codes: img.Codes, Metadata: img.Metadata}); err != nil {
+				return report, errors.Wrapf(err, "line %d", line)
+			}
+			report.Inserted++
+		}
+
+		if img.Edit != nil {
+			// the image was just inserted if no rows were updated
+			if len(updatedIDs) == 0 {
+				id, err := imageIDForHash(ctx, tx, img.Hash)
+				if err != nil {
+					return report, errors.Wrapf(err, "line %d", line)
+				}
+				updatedIDs = append(updatedIDs, id)
+			}
+			for _, id := range updatedIDs {
+				if err = insertEdit(ctx, tx, id, *img.Edit); err != nil {
+					return report, errors.Wrapf(err, "line %d", line)
+				}
+			}
+		}
+
+		if err = insertTags(ctx, tx, img.Hash, img.Tags); err != nil {
+			return report, errors.Wrapf(err, "line %d", line)
+		}
+		if img.Note != "" {
+			if err = setNote(ctx, tx, img.Hash, img.Note); err != nil {
+				return report, errors.Wrapf(err, "line %d", line)
+			}
+		}
+		if err = updateTagText(ctx, tx, img.Hash); err != nil {
+			return report, errors.Wrapf(err, "line %d", line)
+		}
+	}
+
+	return report, errors.Wrapf(tx.Commit(), "tx.Commit")
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Image is the parsed text and words of an image, along with every path it was found at.
+type Image struct {
+	ID    int64     `json:"id"`
+	Hash  string    `json:"hash"`
+	Text  string    `json:"text"`
+	Paths []string  `json:"paths"`
+	Words []WordBox `json:"words"`
+	// Codes are the QR codes and barcodes found within the image, if it was scanned for them.
+	Codes []string `json:"codes,omitempty"`
+	// Metadata is nil for images parsed before searmage stored it.
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	Note     string    `json:"note,omitempty"`
+	// Edit is set if Text was corrected by hand.
+	Edit *Edit `json:"edit,omitempty"`
+}
+
+// GetImage returns the image with the given ID, with it's paths resolved against roots.
+// The error wraps sql.ErrNoRows if there is no such image.
+func GetImage(ctx context.Context, db *sql.DB, roots Roots, id int64) (img Image, err error) {
+	img.ID = id
+	var codes sql.NullString
+	err = db.QueryRowContext(ctx, `SELECT image_hash, image_text, image_codes FROM images WHERE rowid = ?`, id).Scan(&img.Hash, &img.Text, &codes)
+	if err != nil {
+		return img, errors.Wrapf(err, "SELECT images")
+	}
+	img.Codes = splitCodes(codes)
+
+	rows, err := db.QueryContext(ctx, `SELECT root, path FROM files WHERE image_id = ? ORDER BY root, path`, id)
+	if err != nil {
+		return img, errors.Wrapf(err, "SELECT files")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var root, path string
+		if err = rows.Scan(&root, &path); err != nil {
+			return img, errors.Wrapf(err, "rows.Scan")
+		}
+		img.Paths = append(img.Paths, roots.Join(root, path))
+	}
+	if err = rows.Err(); err != nil {
+		return img, errors.Wrapf(err, "rows.Err")
+	}
+
+	if img.Words, err = getWords(ctx, db, id); err != nil {
+		return img, errors.Wrap(err)
+	}
+	if img.Tags, img.Note, err = getTags(ctx, db, img.Hash); err != nil {
+		return img, errors.Wrap(err)
+	}
+	if img.Edit, err = getEdit(ctx, db, id); err != nil {
+		return img, errors.Wrap(err)
+	}
+	img.Metadata, err = GetMetadata(ctx, db, img.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return img, errors.Wrap(err)
+}
+
+// Stats summarizes what's in the database.
+type Stats struct {
+	Images        int   `json:"images"`
+	Files         int   `json:"files"`
+	Roots         int   `json:"roots"`
+	SizeBytes     int64 `json:"size_bytes"`
+	SchemaVersion int   `json:"schema_version"`
+}
+
+// GetStats counts what's in the database.
+func GetStats(ctx context.Context, db *sql.DB) (s Stats, err error) {
+	err = db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM images),
+			(SELECT COUNT(*) FROM files),
+			(SELECT COUNT(*) FROM roots),
+			(SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()),
+			(SELECT user_version FROM pragma_user_version())
+	`).Scan(&s.Images, &s.Files, &s.Roots, &s.SizeBytes, &s.SchemaVersion)
+	return s, errors.Wrap(err)
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"os"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// LockWriter takes an exclusive lock on a file next to the database so only one searmage process writes to it at a time.
+// It fails immediately instead of waiting if another process holds the lock. The returned func releases the lock.
+func LockWriter(dbPath string) (unlock func() error, err error) {
+	lockPath := dbPath + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.OpenFile")
+	}
+
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Errorf("%s is in use by another searmage process (%s) %w", dbPath, lockPath, err)
+	}
+
+	// Closing the file releases the lock. The lock file itself is left behind, since removing it would race with other processes.
+	return func() error { return errors.Wrap(f.Close()) }, nil
+}
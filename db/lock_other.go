@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package db
+
+import "os"
+
+// lockFile is a no-op on platforms without file locking.
+func lockFile(f *os.File) error { return nil }
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// MaintenanceReport describes what Maintain did to the database.
+type MaintenanceReport struct {
+	// SizeBefore and SizeAfter are the database's size in bytes. If VACUUM INTO was used SizeAfter is the backup's size.
+	SizeBefore int64
+	SizeAfter  int64
+	Reclaimed  int64
+	BackupPath string
+}
+
+// Maintain merges the images FTS5 index's b-trees with optimize, then checks the integrity of the index and the database as a whole.
+// If everything checks out the database is VACUUMed to reclaim free pages, or if vacuumInto is set,
+// a compacted backup is written there with VACUUM INTO and the original file is left at it's current size.
+// The caller should hold the lock from LockWriter so another searmage process isn't writing meanwhile.
+func Maintain(ctx context.Context, db *sql.DB, dbPath, vacuumInto string) (r MaintenanceReport, err error) {
+	r.SizeBefore, err = fileSize(dbPath)
+	if err != nil {
+		return r, errors.Wrap(err)
+	}
+
+	// https://www.sqlite.org/fts5.html#the_optimize_command
+	if _, err = db.ExecContext(ctx, `INSERT INTO images(images) VALUES('optimize')`); err != nil {
+		return r, errors.Wrapf(err, "fts5 optimize")
+	}
+	// https://www.sqlite.org/fts5.html#the_integrity_check_command
+	if _, err = db.ExecContext(ctx, `INSERT INTO images(images) VALUES('integrity-check')`); err != nil {
+		return r, errors.Wrapf(err, "fts5 integrity-check")
+	}
+
+	if err = integrityCheck(ctx, db); err != nil {
+		return r, errors.Wrap(err)
+	}
+
+	// With a cancellable context the driver keeps a pending statement stepping on the connection to catch interrupts,
+	// which VACUUM refuses to run alongside, so VACUUM ignores cancellation.
+	ctx = context.WithoutCancel(ctx)
+
+	if vacuumInto != "" {
+		if _, err = db.ExecContext(ctx, `VACUUM INTO ?`, vacuumInto); err != nil {
+			return r, errors.Wrapf(err, "VACUUM INTO")
+		}
+		r.BackupPath = vacuumInto
+		r.SizeAfter, err = fileSize(vacuumInto)
+	} else {
+		if _, err = db.ExecContext(ctx, `VACUUM`); err != nil {
+			return r, errors.Wrapf(err, "VACUUM")
+		}
+		r.SizeAfter, err = fileSize(dbPath)
+	}
+
+	r.Reclaimed = r.SizeBefore - r.SizeAfter
+	return r, errors.Wrap(err)
+}
+
+// CopyDatabase copies the database at srcPath to dstPath with VACUUM INTO, so the copy includes what's still within the write-ahead log.
+// The caller should hold the lock from LockWriter on srcPath so another searmage process isn't writing meanwhile.
+func CopyDatabase(ctx context.Context, srcPath, dstPath string) error {
+	src, err := open(srcPath)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer src.Close()
+	// VACUUM ignores cancellation for the same reason as in Maintain
+	_, err = src.ExecContext(context.WithoutCancel(ctx), `VACUUM INTO ?`, dstPath)
+	return errors.Wrapf(err, "VACUUM INTO")
+}
+
+// integrityCheck runs PRAGMA integrity_check, which returns a single "ok" row unless problems were found.
+func integrityCheck(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			return errors.Wrapf(err, "rows.Scan")
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrapf(err, "rows.Err")
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("PRAGMA integrity_check found problems: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "os.Stat")
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Metadata describes an image's format and size, and what it's EXIF says about how it was taken.
+// Fields the image has no EXIF for are left empty.
+type Metadata struct {
+	// Format is the image's format, such as jpeg or png.
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// TakenAt is when the photo was taken in the camera's local time, formatted as TakenAtLayout.
+	TakenAt     string `json:"taken_at,omitempty"`
+	CameraMake  string `json:"camera_make,omitempty"`
+	CameraModel string `json:"camera_model,omitempty"`
+	// Orientation is the EXIF orientation, from 1 for upright to 8.
+	Orientation int      `json:"orientation,omitempty"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+	// DHash is a perceptual hash of the image as 16 hex digits, which differs by only a few bits between resized or re-saved copies.
+	DHash string `json:"dhash,omitempty"`
+}
+
+// TakenAtLayout formats Metadata.TakenAt so it sorts and compares chronologically as text.
+const TakenAtLayout = "2006-01-02T15:04:05"
+
+// metadataColumns selects the metadata table aliased as m, which may be LEFT JOINed so every column may be NULL.
+// metadataScanner reads them.
+const metadataColumns = `m.image_hash IS NOT NULL, COALESCE(m.format, ''), COALESCE(m.width, 0), COALESCE(m.height, 0),
+	COALESCE(m.taken_at, ''), COALESCE(m.camera_make, ''), COALESCE(m.camera_model, ''), COALESCE(m.orientation, 0), m.latitude, m.longitude, m.dhash`
+
+// metadataScanner holds the destinations for metadataColumns.
+type metadataScanner struct {
+	found bool
+	md    Metadata
+	dhash *int64
+}
+
+func (s *metadataScanner) dest() []any {
+	return []any{&s.found, &s.md.Format, &s.md.Width, &s.md.Height,
+		&s.md.TakenAt, &s.md.CameraMake, &s.md.CameraModel, &s.md.Orientation, &s.md.Latitude, &s.md.Longitude, &s.dhash}
+}
+
+// metadata returns the scanned metadata, or nil if the image had none.
+func (s *metadataScanner) metadata() *Metadata {
+	if !s.found {
+		return nil
+	}
+	md := s.md
+	if s.dhash != nil {
+		md.DHash = FormatDHash(uint64(*s.dhash))
+	}
+	return &md
+}
+
+// GetMetadata returns the metadata stored for the hash. The error wraps sql.ErrNoRows if there is none.
+func GetMetadata(ctx context.Context, db *sql.DB, hash string) (*Metadata, error) {
+	var s metadataScanner
+	err := db.QueryRowContext(ctx, `SELECT `+metadataColumns+` FROM metadata m WHERE m.image_hash = ?`, hash).Scan(s.dest()...)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return s.metadata(), nil
+}
+
+// insertMetadata replaces the metadata stored for the hash.
+func insertMetadata(ctx context.Context, tx *sql.Tx, hash string, md Metadata) error {
+	var dhash *int64
+	if md.DHash != "" {
+		d, err := ParseDHash(md.DHash)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		// SQLite integers are signed, but only the bits matter
+		signed := int64(d)
+		dhash = &signed
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO metadata (image_hash, format, width, height, taken_at, camera_make, camera_model, orientation, latitude, longitude, dhash)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)
+	`, hash, md.Format, md.Width, md.Height, md.TakenAt, md.CameraMake, md.CameraModel, md.Orientation, md.Latitude, md.Longitude, dhash)
+	return errors.Wrapf(err, "INSERT metadata")
+}
+
+// FormatDHash formats a perceptual hash as Metadata.DHash.
+func FormatDHash(dhash uint64) string {
+	return fmt.Sprintf("%016x", dhash)
+}
+
+// ParseDHash parses a perceptual hash formatted as Metadata.DHash.
+func ParseDHash(s string) (uint64, error) {
+	d, err := strconv.ParseUint(s, 16, 64)
+	return d, errors.Wrapf(err, "invalid dhash %q", s)
+}
+
+// metadataFilters limits a search to images whose metadata matches q, returning the conditions and their arguments.
+func metadataFilters(q Query) (where []string, args []any) {
+	if q.Format != "" {
+		where = append(where, "m.format = lower(?)")
+		args = append(args, q.Format)
+	}
+	if q.Camera != "" {
+		// LIKE is case insensitive, and cameras are usually known by their make or model alone
+		where = append(where, "(m.camera_make || ' ' || m.camera_model) LIKE '%' || ? || '%'")
+		args = append(args, q.Camera)
+	}
+	if !q.TakenAfter.IsZero() {
+		where = append(where, "m.taken_at >= ?")
+		args = append(args, q.TakenAfter.Format(TakenAtLayout))
+	}
+	if !q.TakenBefore.IsZero() {
+		where = append(where, "m.taken_at < ?")
+		args = append(args, q.TakenBefore.Format(TakenAtLayout))
+	}
+	if q.HasLocation {
+		where = append(where, "m.latitude IS NOT NULL")
+	}
+	if q.SimilarTo != nil {
+		where = append(where, "hamming(m.dhash, ?) <= ?")
+		args = append(args, int64(*q.SimilarTo), q.MaxDistance)
+	}
+	return where, args
+}
+
+// ParseTakenAt parses a date like 2006-01-02, or a time formatted as TakenAtLayout, for filtering by Metadata.TakenAt.
+func ParseTakenAt(s string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		t, err = time.Parse(TakenAtLayout, s)
+	}
+	return t, errors.Wrapf(err, "expected a date like 2006-01-02 or time like 2006-01-02T15:04:05")
+}
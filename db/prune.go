@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/imagefile"
+)
+
+type fileRow struct {
+	root, path string
+	imageID    int64
+	hash       string
+}
+
+// PrunedFile is a path Prune removed, along with the image it was.
+type PrunedFile struct {
+	Path    string
+	ImageID int64
+	Hash    string
+}
+
+// Prune deletes files that no longer exist from the database, along with their text, words, thumbnail and metadata once no other file shares them.
+// It returns the pruned files, with their paths resolved against roots.
+// Entries within archives are pruned once they're removed from the archive, or the archive is deleted.
+// Files within a root that is unknown or whose directory is missing are left alone, since it's most likely just unmounted.
+func Prune(ctx context.Context, db *sql.DB, roots Roots) (pruned []PrunedFile, err error) {
+	mounted := map[string]bool{"": true}
+	for _, r := range roots {
+		_, err := os.Stat(r.Path)
+		mounted[r.Name] = err == nil
+		if err != nil {
+			slog.Warn("skipping pruning root", "root", r.Name, "err", err)
+		}
+	}
+
+	// archives caches the images within each archive, so archives of hundreds of pages are only read once.
+	archives := map[string]map[string]bool{}
+	exists := func(fPath string) bool {
+		archive, _, ok := imagefile.SplitArchivePath(fPath)
+		if !ok {
+			_, err := os.Stat(fPath)
+			return !errors.Is(err, os.ErrNotExist)
+		}
+		entries, cached := archives[archive]
+		if !cached {
+			list, err := imagefile.ArchiveImages(archive)
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				entries = map[string]bool{}
+			case err != nil:
+				// an archive that can't be read may be mid copy, so it's left alone like an unmounted root
+				slog.Warn("skipping pruning archive", "path", archive, "err", err)
+			default:
+				entries = make(map[string]bool, len(list))
+				for _, e := range list {
+					entries[e.Path] = true
+				}
+			}
+			archives[archive] = entries
+		}
+		return entries == nil || entries[fPath]
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT root, path, image_id, image_hash FROM files`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var missing []fileRow
+	for rows.Next() {
+		var f fileRow
+		if err = rows.Scan(&f.root, &f.path, &f.imageID, &f.hash); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		if !mounted[f.root] {
+			continue
+		}
+		if !exists(roots.Join(f.root, f.path)) {
+			missing = append(missing, f)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "rows.Err")
+	}
+	rows.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	for _, f := range missing {
+		if err = deleteFile(ctx, tx, f); err != nil {
+			return nil, errors.Wrap(err)
+		}
+		pruned = append(pruned, PrunedFile{Path: roots.Join(f.root, f.path), ImageID: f.imageID, Hash: f.hash})
+	}
+	return pruned, errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// deleteFile deletes a files row, and everything it referenced that no other file does.
+func deleteFile(ctx context.Context, tx *sql.Tx, f fileRow) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM files WHERE path = ? AND root = ?`, f.path, f.root)
+	if err != nil {
+		return errors.Wrapf(err, "DELETE files")
+	}
+
+	if err = deleteUnusedImage(ctx, tx, f.imageID); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrap(deleteUnusedHash(ctx, tx, f.hash))
+}
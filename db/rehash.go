@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/hashing"
+	"github.com/danlock/searmage/imagefile"
+)
+
+// RehashReport counts what Rehash did with each image not hashed with the algorithm yet.
+type RehashReport struct {
+	Rehashed int
+	// Merged is how many rehashed images turned out to be copies of an image already hashed with the algorithm.
+	Merged int
+	// Skipped is how many images had no files left to hash, or only ones that changed since they were indexed.
+	Skipped int
+}
+
+// Rehash hashes every image not hashed with alg yet from one of it's files, and stores the new hash in place of the old one without parsing the image again.
+// Each image is committed separately, so an interrupted Rehash picks up where it left off.
+func Rehash(ctx context.Context, db *sql.DB, roots Roots, alg hashing.Algorithm) (report RehashReport, err error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT image_id, MIN(image_hash) FROM files WHERE image_hash NOT LIKE ? || ':%' GROUP BY image_id ORDER BY image_id
+	`, string(alg))
+	if err != nil {
+		return report, errors.Wrapf(err, "db.QueryContext")
+	}
+	type staleImage struct {
+		id   int64
+		hash string
+	}
+	var stale []staleImage
+	for rows.Next() {
+		var img staleImage
+		if err = rows.Scan(&img.id, &img.hash); err != nil {
+			rows.Close()
+			return report, errors.Wrapf(err, "rows.Scan")
+		}
+		stale = append(stale, img)
+	}
+	if err = rows.Close(); err != nil {
+		return report, errors.Wrapf(err, "rows.Close")
+	}
+
+	for _, img := range stale {
+		if err = ctx.Err(); err != nil {
+			return report, errors.Wrap(err)
+		}
+		newHash, err := hashImageFile(ctx, db, roots, img.id, alg)
+		if err != nil {
+			return report, errors.Wrap(err)
+		}
+		if newHash == "" {
+			slog.Warn("skipping rehashing image without readable files", "hash", img.hash)
+			report.Skipped++
+			continue
+		}
+		merged, err := replaceHash(ctx, db, img.id, img.hash, newHash)
+		if err != nil {
+			return report, errors.Wrap(err)
+		}
+		slog.Debug("rehashed", "old", img.hash, "new", newHash, "merged", merged)
+		report.Rehashed++
+		if merged {
+			report.Merged++
+		}
+	}
+	return report, nil
+}
+
+// hashImageFile hashes the first of the image's files that can be read and is the same size as when it was indexed, or returns an empty hash if none are.
+func hashImageFile(ctx context.Context, db *sql.DB, roots Roots, imageID int64, alg hashing.Algorithm) (string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT root, path, size FROM files WHERE image_id = ? ORDER BY root, path`, imageID)
+	if err != nil {
+		return "", errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var root, path string
+		var size int64
+		if err = rows.Scan(&root, &path, &size); err != nil {
+			return "", errors.Wrapf(err, "rows.Scan")
+		}
+		fullPath := roots.Join(root, path)
+		hash, err := hashFile(fullPath, size, alg)
+		if err != nil {
+			slog.Debug("failed rehashing", "path", fullPath, "err", err)
+			continue
+		}
+		return hash, nil
+	}
+	return "", errors.Wrapf(rows.Err(), "rows.Err")
+}
+
+// hashFile hashes the file at fullPath, unless it's size differs from size, which is 0 for files indexed before sizes were stored.
+func hashFile(fullPath string, size int64, alg hashing.Algorithm) (string, error) {
+	f, err := imagefile.Open(fullPath)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	defer f.Close()
+
+	actual, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", errors.Wrapf(err, "f.Seek")
+	}
+	// a changed file's text is stale, so index can parse it again instead
+	if size != 0 && actual != size {
+		return "", errors.Errorf("size changed from %d to %d since it was indexed", size, actual)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrapf(err, "f.Seek")
+	}
+	hash, err := hashing.Sum(alg, f)
+	return hash, errors.Wrap(err)
+}
+
+// replaceHash stores newHash in place of oldHash for the image. If another image already has newHash, it's files are moved to that image instead.
+func replaceHash(ctx context.Context, db *sql.DB, imageID int64, oldHash, newHash string) (merged bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	targetID, err := imageIDForHash(ctx, tx, newHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, errors.Wrap(err)
+	}
+	merged = err == nil && targetID != imageID
+	if !merged {
+		targetID = imageID
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE files SET image_id = ?, image_hash = ? WHERE image_id = ?`, targetID, newHash, imageID); err != nil {
+		return false, errors.Wrapf(err, "UPDATE files")
+	}
+	if merged {
+		if err = moveEdit(ctx, tx, imageID, targetID); err != nil {
+			return false, errors.Wrap(err)
+		}
+		if err = deleteUnusedImage(ctx, tx, imageID); err != nil {
+			return false, errors.Wrap(err)
+		}
+	} else if _, err = tx.ExecContext(ctx, `UPDATE images SET image_hash = ? WHERE rowid = ?`, newHash, imageID); err != nil {
+		return false, errors.Wrapf(err, "UPDATE images")
+	}
+
+	// the thumbnail and metadata of an image merged into are kept, and ours deleted once nothing has the old hash
+	for _, table := range hashTables {
+		if _, err = tx.ExecContext(ctx, `UPDATE OR IGNORE `+table+` SET image_hash = ? WHERE image_hash = ?`, newHash, oldHash); err != nil {
+			return false, errors.Wrapf(err, "UPDATE %s", table)
+		}
+	}
+	if err = deleteUnusedHash(ctx, tx, oldHash); err != nil {
+		return false, errors.Wrap(err)
+	}
+	if err = moveTags(ctx, tx, oldHash, newHash); err != nil {
+		return false, errors.Wrap(err)
+	}
+	if err = updateTagText(ctx, tx, newHash); err != nil {
+		return false, errors.Wrap(err)
+	}
+	return merged, errors.Wrapf(tx.Commit(), "tx.Commit")
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Root is a named directory that image paths are stored relative to,
+// so the database keeps working when the directory is mounted somewhere else.
+type Root struct {
+	Name string
+	Path string
+}
+
+// Roots resolves paths to and from their Root.
+type Roots []Root
+
+// Split returns the name of the deepest Root containing path, along with path relative to it using forward slashes.
+// If no Root contains path, the root name is empty and path is returned unchanged.
+func (rs Roots) Split(path string) (root, rel string) {
+	rel = path
+	if len(rs) == 0 {
+		return root, rel
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return root, rel
+	}
+
+	deepest := -1
+	for _, r := range rs {
+		candidate, err := filepath.Rel(r.Path, abs)
+		if err != nil || candidate == ".." || strings.HasPrefix(candidate, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(r.Path) > deepest {
+			deepest, root, rel = len(r.Path), r.Name, filepath.ToSlash(candidate)
+		}
+	}
+	return root, rel
+}
+
+// Join is the inverse of Split, resolving rel against the current location of root.
+func (rs Roots) Join(root, rel string) string {
+	if root == "" {
+		return rel
+	}
+	for _, r := range rs {
+		if r.Name == root {
+			return filepath.Join(r.Path, filepath.FromSlash(rel))
+		}
+	}
+	// The root is gone, so the best we can do is show where the image was relative to.
+	return root + ":" + rel
+}
+
+// LoadRoots returns the Roots stored in the database. overrides takes precedence over the stored location of a root for this process only.
+func LoadRoots(ctx context.Context, db *sql.DB, overrides map[string]string) (Roots, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, path FROM roots ORDER BY name`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var roots Roots
+	for rows.Next() {
+		var r Root
+		if err = rows.Scan(&r.Name, &r.Path); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		if override, ok := overrides[r.Name]; ok {
+			r.Path = override
+		}
+		roots = append(roots, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "rows.Err")
+	}
+
+	for name, path := range overrides {
+		if !slices.ContainsFunc(roots, func(r Root) bool { return r.Name == name }) {
+			roots = append(roots, Root{Name: name, Path: path})
+		}
+	}
+	return roots, nil
+}
+
+// SetRoot stores the location of a root, adding it if it's new. Paths already stored relative to the root are untouched,
+// so moving a root to where it's directory was remounted remaps all of them without re-indexing.
+// Absolute paths inside it, stored because they were indexed before the root existed, are rebased to be relative to it.
+// If the path was also indexed relative to the root, the absolute duplicate is deleted instead.
+func SetRoot(ctx context.Context, db *sql.DB, name, path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "filepath.Abs")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO roots (name, path) VALUES (?,?)
+		ON CONFLICT (name) DO UPDATE SET path = excluded.path
+	`, name, path)
+	if err != nil {
+		return errors.Wrapf(err, "INSERT roots")
+	}
+	if err = rebaseFiles(ctx, tx, name); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+// rebaseFiles makes the absolute paths within the root relative to it, unless they're within a deeper root.
+func rebaseFiles(ctx context.Context, tx *sql.Tx, name string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT name, path FROM roots`)
+	if err != nil {
+		return errors.Wrapf(err, "SELECT roots")
+	}
+	var roots Roots
+	for rows.Next() {
+		var r Root
+		if err = rows.Scan(&r.Name, &r.Path); err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "rows.Scan")
+		}
+		roots = append(roots, r)
+	}
+	if err = rows.Close(); err != nil {
+		return errors.Wrapf(err, "SELECT roots")
+	}
+	rootPath := roots[slices.IndexFunc(roots, func(r Root) bool { return r.Name == name })].Path
+
+	// substr rather than LIKE, since LIKE ignores case and treats _ and % within the path as wildcards
+	prefix := strings.TrimSuffix(rootPath, string(filepath.Separator)) + string(filepath.Separator)
+	rows, err = tx.QueryContext(ctx, `
+		SELECT path, image_id, image_hash FROM files WHERE root = '' AND substr(path, 1, length(?1)) = ?1
+	`, prefix)
+	if err != nil {
+		return errors.Wrapf(err, "SELECT files")
+	}
+	var files []fileRow
+	for rows.Next() {
+		var f fileRow
+		if err = rows.Scan(&f.path, &f.imageID, &f.hash); err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "rows.Scan")
+		}
+		files = append(files, f)
+	}
+	if err = rows.Close(); err != nil {
+		return errors.Wrapf(err, "SELECT files")
+	}
+
+	for _, f := range files {
+		root, rel := roots.Split(f.path)
+		if root != name {
+			continue
+		}
+		var duplicate bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM files WHERE path = ? AND root = ?)`, rel, root).Scan(&duplicate)
+		if err != nil {
+			return errors.Wrapf(err, "SELECT files")
+		}
+		if duplicate {
+			if err = deleteFile(ctx, tx, f); err != nil {
+				return errors.Wrap(err)
+			}
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE files SET path = ?, root = ? WHERE path = ? AND root = ''`, rel, root, f.path)
+		if err != nil {
+			return errors.Wrapf(err, "UPDATE files")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// SavedSearch is a named search stored in the database, so images indexed since it was last checked can be found.
+type SavedSearch struct {
+	Name string     `json:"name"`
+	Text string     `json:"text"`
+	Mode SearchMode `json:"mode"`
+	// CheckedAt is when it was last checked for new matches, or when it was saved if it never was.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// SaveSearch stores s under it's name, replacing the search saved under it before but keeping when it was checked.
+// The search is run once first, so invalid syntax is reported now instead of when it's checked.
+func SaveSearch(ctx context.Context, db *sql.DB, s SavedSearch) error {
+	if s.Name = strings.TrimSpace(s.Name); s.Name == "" {
+		return errors.New("saved searches need a name")
+	}
+	if s.Text == "" {
+		return errors.New("saved searches need text to search for")
+	}
+	if s.Mode == "" {
+		s.Mode = SearchMatch
+	}
+	if _, _, err := Search(ctx, db, nil, Query{Text: s.Text, Mode: s.Mode, Limit: 1}); err != nil {
+		return errors.Wrap(err)
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO saved_searches (name, text, mode, checked_at) VALUES (?,?,?,?)
+		ON CONFLICT (name) DO UPDATE SET text = excluded.text, mode = excluded.mode
+	`, s.Name, s.Text, s.Mode, modTime(time.Now()))
+	return errors.Wrapf(err, "INSERT saved_searches")
+}
+
+// DeleteSavedSearch deletes the search saved under name. The error wraps sql.ErrNoRows if there isn't one.
+func DeleteSavedSearch(ctx context.Context, db *sql.DB, name string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM saved_searches WHERE name = ?`, name)
+	if err != nil {
+		return errors.Wrapf(err, "DELETE saved_searches")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "res.RowsAffected")
+	} else if n == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "no search is saved as %s", name)
+	}
+	return nil
+}
+
+// SavedSearches returns the saved searches ordered by name.
+func SavedSearches(ctx context.Context, db *sql.DB) ([]SavedSearch, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, text, mode, checked_at FROM saved_searches ORDER BY name`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var searches []SavedSearch
+	for rows.Next() {
+		var s SavedSearch
+		var checkedAt int64
+		if err = rows.Scan(&s.Name, &s.Text, &s.Mode, &checkedAt); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		s.CheckedAt = time.Unix(0, checkedAt)
+		searches = append(searches, s)
+	}
+	return searches, errors.Wrapf(rows.Err(), "rows.Err")
+}
+
+// CheckSavedSearch returns the paths indexed as new images since the search saved under name was last checked that match it,
+// then marks it checked. The error wraps sql.ErrNoRows if there isn't one.
+func CheckSavedSearch(ctx context.Context, db *sql.DB, roots Roots, name string) ([]SearchResult, error) {
+	var s SavedSearch
+	var checkedAt int64
+	err := db.QueryRowContext(ctx, `SELECT name, text, mode, checked_at FROM saved_searches WHERE name = ?`, name).
+		Scan(&s.Name, &s.Text, &s.Mode, &checkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(err, "no search is saved as %s", name)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "SELECT saved_searches")
+	}
+
+	// images indexed while we search are left for the next check, rather than being found now and again then.
+	// The next check starts at now inclusively, so nothing indexed at exactly now falls between the two.
+	now := time.Now()
+	results, _, err := Search(ctx, db, roots, Query{Text: s.Text, Mode: s.Mode, IndexedAfter: time.Unix(0, checkedAt).Add(-1), IndexedBefore: now})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	_, err = db.ExecContext(ctx, `UPDATE saved_searches SET checked_at = ? WHERE name = ?`, modTime(now), name)
+	return results, errors.Wrapf(err, "UPDATE saved_searches")
+}
+
+// MatchSavedSearches returns which of searches the image matches.
+// It's called for every image indexed, so each search only checks the image's row instead of running in full.
+func MatchSavedSearches(ctx context.Context, db *sql.DB, searches []SavedSearch, imageID int64) ([]SavedSearch, error) {
+	var matches []SavedSearch
+	for _, s := range searches {
+		var where string
+		switch s.Mode {
+		case SearchMatch, "":
+			where = "images MATCH ?"
+		case SearchRegex:
+			where = searchableText + " REGEXP ?"
+		default:
+			return nil, errors.Errorf("saved search %s has unknown search mode %s", s.Name, s.Mode)
+		}
+		var match bool
+		err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM images WHERE rowid = ? AND `+where+`)`, imageID, s.Text).Scan(&match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "saved search %s", s.Name)
+		}
+		if match {
+			matches = append(matches, s)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchSavedSearches(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	dir := t.TempDir()
+	for _, img := range []ParsedImage{
+		{Path: filepath.Join(dir, "receipt.png"), Hash: "md5:receipt", Text: "total 42.00"},
+		{Path: filepath.Join(dir, "ticket.png"), Hash: "md5:ticket", Text: "admit one"},
+	} {
+		if err := InsertParsedText(ctx, db, nil, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	searches := []SavedSearch{
+		{Name: "totals", Text: "total", Mode: SearchMatch},
+		{Name: "prices", Text: `\d+\.\d\d`, Mode: SearchRegex},
+		{Name: "tickets", Text: "admit"},
+	}
+
+	matches, err := MatchSavedSearches(ctx, db, searches, hashImageID(t, ctx, db, "md5:receipt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Name != "totals" || matches[1].Name != "prices" {
+		t.Fatalf("got %+v, want totals and prices", matches)
+	}
+	matches, err = MatchSavedSearches(ctx, db, searches, hashImageID(t, ctx, db, "md5:ticket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Name != "tickets" {
+		t.Fatalf("got %+v, want tickets", matches)
+	}
+}
+
+func TestCheckSavedSearch(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	dir := t.TempDir()
+	if err := SaveSearch(ctx, db, SavedSearch{Name: "totals", Text: "total"}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(want ...string) {
+		t.Helper()
+		results, err := CheckSavedSearch(ctx, db, nil, "totals")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(want) {
+			t.Fatalf("got %+v, want %v", results, want)
+		}
+		for i := range want {
+			if results[i].Path != want[i] {
+				t.Fatalf("got %+v, want %v", results, want)
+			}
+		}
+	}
+
+	first := filepath.Join(dir, "first.png")
+	if err := InsertParsedText(ctx, db, nil, ParsedImage{Path: first, Hash: "md5:first", Text: "total 1"}); err != nil {
+		t.Fatal(err)
+	}
+	check(first)
+	// each image is only found by the first check after it's indexed
+	check()
+	second := filepath.Join(dir, "second.png")
+	if err := InsertParsedText(ctx, db, nil, ParsedImage{Path: second, Hash: "md5:second", Text: "total 2"}); err != nil {
+		t.Fatal(err)
+	}
+	check(second)
+}
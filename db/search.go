@@ -0,0 +1,242 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// SearchMode is how Query.Text is matched against image text.
+type SearchMode string
+
+const (
+	// SearchMatch uses FTS5 MATCH syntax and orders results by relevance. https://www.sqlite.org/fts5.html
+	SearchMatch SearchMode = "match"
+	// SearchRegex uses REGEXP with https://pkg.go.dev/regexp/syntax and orders results by path.
+	SearchRegex SearchMode = "regex"
+)
+
+// Query describes a search through the parsed text of images, the QR codes and barcodes found within them, and their tags and notes.
+type Query struct {
+	// Text may be empty to search by the other filters alone.
+	Text string
+	Mode SearchMode
+	// Root limits results to images within the named root.
+	Root string
+	// PathPrefix limits results to images whose path, resolved against it's root, starts with it.
+	PathPrefix string
+	// Limit and Offset paginate results. A Limit of 0 returns them all.
+	Limit  int
+	Offset int
+	// Snippets includes an excerpt of the text around the match in each result, with the match wrapped in Highlight.
+	Snippets  bool
+	Highlight [2]string
+	// Format, Camera, TakenAfter, TakenBefore and HasLocation limit results by their Metadata, excluding images without it.
+	// Format is matched exactly, Camera as part of the make or model. TakenBefore is exclusive.
+	Format      string
+	Camera      string
+	TakenAfter  time.Time
+	TakenBefore time.Time
+	HasLocation bool
+	// SimilarTo limits results to images whose perceptual hash is within MaxDistance bits of it, ordered by how similar they are.
+	SimilarTo   *uint64
+	MaxDistance int
+	// Collapse returns copies of an image found at several paths as one result, with the first matching path.
+	Collapse bool
+	// Tags limits results to images with every one of these tags.
+	Tags []string
+	// IndexedAfter and IndexedBefore limit results to paths indexed as a new image between them, see SavedSearch.
+	// IndexedBefore is exclusive.
+	IndexedAfter  time.Time
+	IndexedBefore time.Time
+	// ImageID limits results to the paths of one image, if set.
+	ImageID int64
+}
+
+// SearchResult is an image file matching a Query.
+type SearchResult struct {
+	ImageID int64  `json:"image_id"`
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Snippet string `json:"snippet,omitempty"`
+	// Duplicates is how many other paths the image is also at, if Query.Collapse was set.
+	Duplicates int `json:"duplicates,omitempty"`
+	// Metadata is nil for images parsed before searmage stored it.
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// searchableText is an image's text followed by it's codes, tags and note, for REGEXP searches.
+const searchableText = "(images.image_text || char(10) || COALESCE(images.image_codes, '') || char(10) || COALESCE(images.image_tags, '') || char(10) || COALESCE(images.image_note, ''))"
+
+// DefaultHighlight wraps matches within snippets if Query.Highlight isn't set.
+var DefaultHighlight = [2]string{"[", "]"}
+
+// snippetTokens is roughly how many words of context a snippet includes.
+const snippetTokens = 16
+
+// Search returns the image files matching q, resolved against roots, along with the total amount of matches regardless of Limit.
+func Search(ctx context.Context, db *sql.DB, roots Roots, q Query) (results []SearchResult, total int, err error) {
+	if q.Highlight == [2]string{} {
+		q.Highlight = DefaultHighlight
+	}
+
+	var where []string
+	var qArgs, snippetArgs []any
+	snippetCol, orderBy := "''", ""
+	var re *regexp.Regexp
+
+	switch q.Mode {
+	case SearchMatch, "":
+		if q.Text == "" {
+			// filters such as SimilarTo may be searched without any text
+			orderBy = "f.root, f.path"
+			break
+		}
+		if q.Snippets {
+			// -1 excerpts whichever of the text, codes, tags or note matched best
+			snippetCol = "snippet(images, -1, ?, ?, '…', ?)"
+			snippetArgs = []any{q.Highlight[0], q.Highlight[1], snippetTokens}
+		}
+		// matching the table rather than a column searches the codes, tags and note too
+		where = append(where, "images MATCH ?")
+		orderBy = "rank"
+	case SearchRegex:
+		// snippet() only works with MATCH, so we find the match in Go.
+		if re, err = regexp.Compile(q.Text); err != nil {
+			return nil, 0, errors.Wrapf(err, "regexp.Compile")
+		}
+		if q.Snippets {
+			snippetCol = searchableText
+		}
+		where = append(where, searchableText+" REGEXP ?")
+		orderBy = "f.root, f.path"
+	default:
+		return nil, 0, errors.Errorf("unknown search mode %s", q.Mode)
+	}
+	if len(where) > 0 {
+		qArgs = append(snippetArgs, q.Text)
+	}
+
+	pathWhere, pathArgs := pathFilters(roots, q, "f")
+	where, qArgs = append(where, pathWhere...), append(qArgs, pathArgs...)
+	duplicatesCol := "0"
+	if q.Collapse {
+		// keep the first of the image's paths that matches, so it isn't lost to a copy outside of Root or PathPrefix
+		copyWhere, copyArgs := pathFilters(roots, q, "f2")
+		copyWhere = append([]string{"f2.image_id = f.image_id", "(f2.root, f2.path) < (f.root, f.path)"}, copyWhere...)
+		where = append(where, "NOT EXISTS (SELECT 1 FROM files f2 WHERE "+strings.Join(copyWhere, " AND ")+")")
+		qArgs = append(qArgs, copyArgs...)
+		duplicatesCol = "(SELECT COUNT(*) - 1 FROM files f2 WHERE f2.image_id = f.image_id)"
+	}
+	mdWhere, mdArgs := metadataFilters(q)
+	where, qArgs = append(where, mdWhere...), append(qArgs, mdArgs...)
+	if !q.IndexedAfter.IsZero() {
+		where, qArgs = append(where, "f.indexed_at > ?"), append(qArgs, modTime(q.IndexedAfter))
+	}
+	if !q.IndexedBefore.IsZero() {
+		where, qArgs = append(where, "f.indexed_at < ?"), append(qArgs, modTime(q.IndexedBefore))
+	}
+	if q.ImageID != 0 {
+		where, qArgs = append(where, "f.image_id = ?"), append(qArgs, q.ImageID)
+	}
+	for _, tag := range q.Tags {
+		where, qArgs = append(where, "EXISTS (SELECT 1 FROM tags t WHERE t.image_hash = f.image_hash AND t.tag = ?)"), append(qArgs, strings.TrimSpace(tag))
+	}
+
+	whereSQL := "TRUE"
+	if len(where) > 0 {
+		whereSQL = strings.Join(where, " AND ")
+	}
+	// snippet() can't be used alongside window functions like COUNT(*) OVER (), so count separately
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM images JOIN files f ON f.image_id = images.rowid LEFT JOIN metadata m ON m.image_hash = f.image_hash
+		WHERE `+whereSQL,
+		qArgs[len(snippetArgs):]...).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "SELECT COUNT(*)")
+	}
+
+	limit := -1
+	if q.Limit > 0 {
+		limit = q.Limit
+	}
+	if q.SimilarTo != nil {
+		orderBy = "hamming(m.dhash, ?), " + orderBy
+		qArgs = append(qArgs, int64(*q.SimilarTo))
+	}
+	qArgs = append(qArgs, limit, q.Offset)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT images.rowid, f.root, f.path, f.image_hash, `+duplicatesCol+`, `+snippetCol+`, `+metadataColumns+`
+		FROM images JOIN files f ON f.image_id = images.rowid LEFT JOIN metadata m ON m.image_hash = f.image_hash
+		WHERE `+whereSQL+`
+		ORDER BY `+orderBy+` LIMIT ? OFFSET ?`, qArgs...)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SearchResult
+		var root string
+		var md metadataScanner
+		if err = rows.Scan(append([]any{&r.ImageID, &root, &r.Path, &r.Hash, &r.Duplicates, &r.Snippet}, md.dest()...)...); err != nil {
+			return nil, 0, errors.Wrapf(err, "rows.Scan")
+		}
+		r.Path, r.Metadata = roots.Join(root, r.Path), md.metadata()
+		if re != nil && q.Snippets {
+			r.Snippet = regexSnippet(re, r.Snippet, q.Highlight)
+		}
+		results = append(results, r)
+	}
+	return results, total, errors.Wrapf(rows.Err(), "rows.Err")
+}
+
+// pathFilters limits the files table aliased as alias to q's Root and PathPrefix, returning the conditions and their arguments.
+func pathFilters(roots Roots, q Query, alias string) (where []string, args []any) {
+	if q.Root != "" {
+		where = append(where, alias+".root = ?")
+		args = append(args, q.Root)
+	}
+	if q.PathPrefix != "" {
+		root, rel := roots.Split(q.PathPrefix)
+		if rel == "." {
+			rel = ""
+		}
+		where = append(where, alias+".root = ? AND substr("+alias+".path, 1, length(?)) = ?")
+		args = append(args, root, rel, rel)
+	}
+	return where, args
+}
+
+// regexSnippet mimics FTS5's snippet() for REGEXP searches, excerpting text around re's first match.
+func regexSnippet(re *regexp.Regexp, text string, highlight [2]string) string {
+	loc := re.FindStringIndex(text)
+	if loc == nil {
+		return ""
+	}
+	before := strings.Fields(text[:loc[0]])
+	after := strings.Fields(text[loc[1]:])
+
+	var b strings.Builder
+	if len(before) > snippetTokens/2 {
+		before = before[len(before)-snippetTokens/2:]
+		b.WriteString("…")
+	}
+	for _, w := range before {
+		b.WriteString(w + " ")
+	}
+	b.WriteString(highlight[0] + text[loc[0]:loc[1]] + highlight[1])
+	for i, w := range after {
+		if i == snippetTokens/2 {
+			b.WriteString("…")
+			break
+		}
+		b.WriteString(" " + w)
+	}
+	return b.String()
+}
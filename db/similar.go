@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math/bits"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/ncruces/go-sqlite3"
+)
+
+// SimilarImage is an image whose perceptual hash is close to another's.
+type SimilarImage struct {
+	ImageID int64    `json:"image_id"`
+	Hash    string   `json:"hash"`
+	Paths   []string `json:"paths"`
+	// Distance is how many bits it's perceptual hash differs by.
+	Distance int `json:"distance"`
+}
+
+// SimilarTo returns the images whose perceptual hash is within maxDistance bits of dhash, most similar first.
+func SimilarTo(ctx context.Context, db *sql.DB, roots Roots, dhash uint64, maxDistance int) ([]SimilarImage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT image_id, image_hash, distance FROM (
+			SELECT DISTINCT f.image_id, f.image_hash, hamming(m.dhash, ?) AS distance
+			FROM files f JOIN metadata m ON m.image_hash = f.image_hash
+		) WHERE distance <= ? ORDER BY distance, image_id`, int64(dhash), maxDistance)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var similar []SimilarImage
+	for rows.Next() {
+		var s SimilarImage
+		if err = rows.Scan(&s.ImageID, &s.Hash, &s.Distance); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		similar = append(similar, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "rows.Err")
+	}
+	return similar, errors.Wrap(addPaths(ctx, db, roots, similar))
+}
+
+// SimilarGroups groups images whose perceptual hashes are within maxDistance bits of each other, either directly or through other images in the group.
+// Each image's Distance is from the first image in it's group. Images without a similar image aren't returned.
+func SimilarGroups(ctx context.Context, db *sql.DB, roots Roots, maxDistance int) ([][]SimilarImage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT f.image_id, f.image_hash, m.dhash
+		FROM files f JOIN metadata m ON m.image_hash = f.image_hash
+		WHERE m.dhash IS NOT NULL ORDER BY f.image_id`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	var images []SimilarImage
+	var dhashes []uint64
+	for rows.Next() {
+		var s SimilarImage
+		var dhash int64
+		if err = rows.Scan(&s.ImageID, &s.Hash, &dhash); err != nil {
+			return nil, errors.Wrapf(err, "rows.Scan")
+		}
+		images, dhashes = append(images, s), append(dhashes, uint64(dhash))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "rows.Err")
+	}
+	rows.Close()
+
+	// union find over the pairs within maxDistance bits
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	// Split the dhashes into maxDistance+1 bands. Hashes within maxDistance bits of each other differ in at most maxDistance bands,
+	// so by the pigeonhole principle they're identical in at least one, and only hashes sharing a band need comparing.
+	// Past 63 bits every pair is within maxDistance, so the bands are empty and everything shares one bucket.
+	if maxDistance < 0 {
+		return nil, nil
+	}
+	bands := maxDistance + 1
+	width := 64 / bands
+	if width == 0 {
+		bands = 1
+	}
+	mask := uint64(1)<<width - 1
+	for band := range bands {
+		buckets := map[uint64][]int{}
+		for i, dhash := range dhashes {
+			key := dhash >> (band * width) & mask
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, bucket := range buckets {
+			for a, i := range bucket {
+				for _, j := range bucket[a+1:] {
+					if find(i) != find(j) && bits.OnesCount64(dhashes[i]^dhashes[j]) <= maxDistance {
+						parent[find(j)] = find(i)
+					}
+				}
+			}
+		}
+	}
+
+	members := map[int][]int{}
+	var order []int
+	for i := range images {
+		root := find(i)
+		if _, ok := members[root]; !ok {
+			order = append(order, root)
+		}
+		members[root] = append(members[root], i)
+	}
+
+	var groups [][]SimilarImage
+	for _, root := range order {
+		if len(members[root]) < 2 {
+			continue
+		}
+		first := members[root][0]
+		group := make([]SimilarImage, 0, len(members[root]))
+		for _, i := range members[root] {
+			images[i].Distance = bits.OnesCount64(dhashes[first] ^ dhashes[i])
+			group = append(group, images[i])
+		}
+		if err = addPaths(ctx, db, roots, group); err != nil {
+			return nil, errors.Wrap(err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// addPaths fills in the paths of each image, resolved against roots.
+func addPaths(ctx context.Context, db *sql.DB, roots Roots, images []SimilarImage) error {
+	ids := make([]int64, len(images))
+	index := make(map[int64]int, len(images))
+	for i, img := range images {
+		ids[i], index[img.ImageID] = img.ImageID, i
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT image_id, root, path FROM files WHERE image_id IN array(?) ORDER BY root, path`, sqlite3.Pointer(ids))
+	if err != nil {
+		return errors.Wrapf(err, "db.QueryContext")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var root, path string
+		if err = rows.Scan(&id, &root, &path); err != nil {
+			return errors.Wrapf(err, "rows.Scan")
+		}
+		images[index[id]].Paths = append(images[index[id]].Paths, roots.Join(root, path))
+	}
+	return errors.Wrapf(rows.Err(), "rows.Err")
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/hashing"
+)
+
+// ImageHash returns the hash of the image indexed at path, or if path isn't indexed, of the file at path if an image with it's hash is, such as after it was renamed.
+// The error wraps sql.ErrNoRows if neither is indexed.
+func ImageHash(ctx context.Context, db *sql.DB, roots Roots, path string, alg hashing.Algorithm) (hash string, err error) {
+	root, relPath := roots.Split(path)
+	err = db.QueryRowContext(ctx, `SELECT image_hash FROM files WHERE path = ? AND root = ?`, relPath, root).Scan(&hash)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return hash, errors.Wrapf(err, "SELECT files")
+	}
+
+	if hash, err = hashFile(path, 0, alg); err != nil {
+		return "", errors.Wrap(err)
+	}
+	var indexed bool
+	if err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM files WHERE image_hash = ?)`, hash).Scan(&indexed); err != nil {
+		return "", errors.Wrapf(err, "SELECT files")
+	}
+	if !indexed {
+		return "", errors.Wrapf(sql.ErrNoRows, "%s isn't indexed", path)
+	}
+	return hash, nil
+}
+
+// userHashTables hold what users added to an image by it's hash. Unlike hashTables they're kept once no files have the hash,
+// so an image that was pruned or changed gets them back when it's indexed again. Only RemoveTags and SetNote delete them,
+// besides moveTags when the image is rehashed.
+var userHashTables = []string{"tags", "notes"}
+
+// AddTags tags the image with the hash. Tags are compared case insensitively, and may contain spaces.
+func AddTags(ctx context.Context, db *sql.DB, hash string, tags []string) error {
+	return errors.Wrap(editTags(ctx, db, hash, func(tx *sql.Tx) error {
+		return errors.Wrap(insertTags(ctx, tx, hash, tags))
+	}))
+}
+
+// RemoveTags removes the tags from the image with the hash, ignoring ones it doesn't have.
+func RemoveTags(ctx context.Context, db *sql.DB, hash string, tags []string) error {
+	return errors.Wrap(editTags(ctx, db, hash, func(tx *sql.Tx) error {
+		for _, tag := range tags {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM tags WHERE image_hash = ? AND tag = ?`, hash, strings.TrimSpace(tag)); err != nil {
+				return errors.Wrapf(err, "DELETE tags")
+			}
+		}
+		return nil
+	}))
+}
+
+// SetNote replaces the note of the image with the hash, or removes it if note is empty.
+func SetNote(ctx context.Context, db *sql.DB, hash, note string) error {
+	return errors.Wrap(editTags(ctx, db, hash, func(tx *sql.Tx) error {
+		return errors.Wrap(setNote(ctx, tx, hash, note))
+	}))
+}
+
+// editTags runs edit within a transaction, then updates the text searches match the image's tags and note by.
+func editTags(ctx context.Context, db *sql.DB, hash string, edit func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "db.BeginTx")
+	}
+	defer tx.Rollback()
+
+	if err = edit(tx); err != nil {
+		return errors.Wrap(err)
+	}
+	if err = updateTagText(ctx, tx, hash); err != nil {
+		return errors.Wrap(err)
+	}
+	return errors.Wrapf(tx.Commit(), "tx.Commit")
+}
+
+func insertTags(ctx context.Context, tx *sql.Tx, hash string, tags []string) error {
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			return errors.New("tags can't be empty")
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO tags (image_hash, tag) VALUES (?,?)`, hash, tag); err != nil {
+			return errors.Wrapf(err, "INSERT tags")
+		}
+	}
+	return nil
+}
+
+func setNote(ctx context.Context, tx *sql.Tx, hash, note string) error {
+	if note = strings.TrimSpace(note); note == "" {
+		_, err := tx.ExecContext(ctx, `DELETE FROM notes WHERE image_hash = ?`, hash)
+		return errors.Wrapf(err, "DELETE notes")
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO notes (image_hash, note) VALUES (?,?)
+		ON CONFLICT (image_hash) DO UPDATE SET note = excluded.note
+	`, hash, note)
+	return errors.Wrapf(err, "INSERT notes")
+}
+
+// moveTags gives the image with newHash the tags and note of oldHash, such as when it's rehashed.
+// Tags it has already are dropped, and if it has a different note already, ours is appended to it.
+func moveTags(ctx context.Context, tx *sql.Tx, oldHash, newHash string) error {
+	_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO tags (image_hash, tag) SELECT ?, tag FROM tags WHERE image_hash = ?`, newHash, oldHash)
+	if err != nil {
+		return errors.Wrapf(err, "INSERT tags")
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM tags WHERE image_hash = ?`, oldHash); err != nil {
+		return errors.Wrapf(err, "DELETE tags")
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO notes (image_hash, note) SELECT ?, note FROM notes WHERE image_hash = ?
+		ON CONFLICT (image_hash) DO UPDATE SET note = note || char(10) || char(10) || excluded.note WHERE note != excluded.note
+	`, newHash, oldHash)
+	if err != nil {
+		return errors.Wrapf(err, "INSERT notes")
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM notes WHERE image_hash = ?`, oldHash)
+	return errors.Wrapf(err, "DELETE notes")
+}
+
+// updateTagText copies the tags and note of the hash into it's images row, so searches match them.
+func updateTagText(ctx context.Context, tx *sql.Tx, hash string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE images SET
+			image_tags = (SELECT group_concat(tag, char(10)) FROM (SELECT tag FROM tags WHERE image_hash = ? ORDER BY tag)),
+			image_note = (SELECT note FROM notes WHERE image_hash = ?)
+		WHERE rowid IN (SELECT image_id FROM files WHERE image_hash = ?)
+	`, hash, hash, hash)
+	return errors.Wrapf(err, "UPDATE images")
+}
+
+// getTags returns the tags and note of the hash.
+func getTags(ctx context.Context, db *sql.DB, hash string) (tags []string, note string, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT tag FROM tags WHERE image_hash = ? ORDER BY tag`, hash)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "SELECT tags")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, "", errors.Wrapf(err, "rows.Scan")
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", errors.Wrapf(err, "rows.Err")
+	}
+
+	err = db.QueryRowContext(ctx, `SELECT note FROM notes WHERE image_hash = ?`, hash).Scan(&note)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return tags, note, errors.Wrapf(err, "SELECT notes")
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/danlock/searmage/hashing"
+)
+
+// checkTags fails the test unless the hash has the tags and note, and a search for them finds path.
+func checkTags(t *testing.T, ctx context.Context, db *sql.DB, hash string, wantTags []string, wantNote, path string) {
+	t.Helper()
+	tags, note, err := getTags(ctx, db, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tags, wantTags) || note != wantNote {
+		t.Fatalf("got tags %v and note %q, want %v and %q", tags, note, wantTags, wantNote)
+	}
+	for _, text := range []string{"image_tags: " + wantTags[0], "image_note: " + wantNote} {
+		results, _, err := Search(ctx, db, nil, Query{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Path != path {
+			t.Fatalf("searching %q got %+v, want %s", text, results, path)
+		}
+	}
+}
+
+func TestPruneKeepsTags(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	path := filepath.Join(t.TempDir(), "receipt.png")
+	writeImage(t, path, "receipt")
+	img := ParsedImage{Path: path, Hash: "md5:receipt", Text: "total 42"}
+
+	if err := InsertParsedText(ctx, db, nil, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddTags(ctx, db, img.Hash, []string{"accounting"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetNote(ctx, db, img.Hash, "paid"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := Prune(ctx, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].Path != path {
+		t.Fatalf("pruned %+v, want %s", pruned, path)
+	}
+	tags, note, err := getTags(ctx, db, img.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || note != "paid" {
+		t.Fatalf("prune left tags %v and note %q", tags, note)
+	}
+
+	// the image comes back, such as when a drive is plugged back in, and is indexed again
+	writeImage(t, path, "receipt")
+	if err = InsertParsedText(ctx, db, nil, img); err != nil {
+		t.Fatal(err)
+	}
+	checkTags(t, ctx, db, img.Hash, []string{"accounting"}, "paid", path)
+}
+
+func TestRehashKeepsTags(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	dir := t.TempDir()
+	path, copyPath := filepath.Join(dir, "receipt.png"), filepath.Join(dir, "copy.png")
+	writeImage(t, path, "receipt")
+	writeImage(t, copyPath, "receipt")
+	newHash, err := hashing.Sum(hashing.XXHash, strings.NewReader("receipt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the copy was indexed with the new hash already, so rehashing merges the original into it
+	if err = InsertParsedText(ctx, db, nil, ParsedImage{Path: path, Hash: "md5:receipt", Text: "total 42"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = InsertParsedText(ctx, db, nil, ParsedImage{Path: copyPath, Hash: newHash, Text: "total 42"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = AddTags(ctx, db, "md5:receipt", []string{"accounting"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetNote(ctx, db, "md5:receipt", "paid"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Rehash(ctx, db, nil, hashing.XXHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Merged != 1 {
+		t.Fatalf("got %+v, want 1 merged", report)
+	}
+	tags, note, err := getTags(ctx, db, newHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tags, []string{"accounting"}) || note != "paid" {
+		t.Fatalf("got tags %v and note %q after rehashing", tags, note)
+	}
+}
+
+func TestRehashMergesTags(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	dir := t.TempDir()
+	path, copyPath := filepath.Join(dir, "receipt.png"), filepath.Join(dir, "copy.png")
+	writeImage(t, path, "receipt")
+	writeImage(t, copyPath, "receipt")
+	newHash, err := hashing.Sum(hashing.XXHash, strings.NewReader("receipt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both copies were tagged and noted before they were found to be the same image
+	for _, img := range []struct {
+		path, hash string
+		tags       []string
+		note       string
+	}{
+		{path, "md5:receipt", []string{"accounting", "tax"}, "paid"},
+		{copyPath, newHash, []string{"Accounting", "2024"}, "filed"},
+	} {
+		if err = InsertParsedText(ctx, db, nil, ParsedImage{Path: img.path, Hash: img.hash, Text: "total 42"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = AddTags(ctx, db, img.hash, img.tags); err != nil {
+			t.Fatal(err)
+		}
+		if err = SetNote(ctx, db, img.hash, img.note); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = Rehash(ctx, db, nil, hashing.XXHash); err != nil {
+		t.Fatal(err)
+	}
+	tags, note, err := getTags(ctx, db, newHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tags, []string{"2024", "Accounting", "tax"}) || note != "filed\n\npaid" {
+		t.Fatalf("got tags %v and note %q after rehashing", tags, note)
+	}
+
+	// nothing is left behind under the old hash
+	var orphans int
+	err = db.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM tags WHERE image_hash = ?1) + (SELECT COUNT(*) FROM notes WHERE image_hash = ?1)`, "md5:receipt").Scan(&orphans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Fatalf("%d tags and notes were left under the old hash", orphans)
+	}
+}
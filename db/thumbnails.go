@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// HasThumbnail reports whether a thumbnail is stored for the hash.
+func HasThumbnail(ctx context.Context, db *sql.DB, hash string) (has bool, err error) {
+	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM thumbnails WHERE image_hash = ?)`, hash).Scan(&has)
+	return has, errors.Wrap(err)
+}
+
+// GetThumbnail returns the JPEG thumbnail stored for the hash. The error wraps sql.ErrNoRows if there is none.
+func GetThumbnail(ctx context.Context, db *sql.DB, hash string) (thumb []byte, err error) {
+	err = db.QueryRowContext(ctx, `SELECT data FROM thumbnails WHERE image_hash = ?`, hash).Scan(&thumb)
+	return thumb, errors.Wrap(err)
+}
+
+// hashTables store what's known about an image by it's hash rather than image_id, so it's shared by copies indexed separately.
+var hashTables = []string{"thumbnails", "metadata"}
+
+// deleteUnusedHash deletes the thumbnail and metadata for the hash if no files have it anymore. It's tags and note are kept, see userHashTables.
+func deleteUnusedHash(ctx context.Context, tx *sql.Tx, hash string) error {
+	for _, table := range hashTables {
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM `+table+` WHERE image_hash = ? AND NOT EXISTS (SELECT 1 FROM files WHERE image_hash = ?)
+		`, hash, hash)
+		if err != nil {
+			return errors.Wrapf(err, "DELETE %s", table)
+		}
+	}
+	return nil
+}
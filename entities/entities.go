@@ -0,0 +1,189 @@
+// Package entities finds typed values such as URLs, email addresses and phone numbers within text, so they can be listed without knowing how to search for them.
+package entities
+
+import (
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Type is a kind of entity.
+type Type string
+
+const (
+	URL   Type = "url"
+	Email Type = "email"
+	Phone Type = "phone"
+	IP    Type = "ip"
+	Date  Type = "date"
+	Money Type = "money"
+)
+
+// Types lists every Type.
+var Types = []Type{URL, Email, Phone, IP, Date, Money}
+
+// ParseType returns the Type named s.
+func ParseType(s string) (Type, error) {
+	t := Type(strings.ToLower(s))
+	if !slices.Contains(Types, t) {
+		return "", errors.Errorf("unknown entity type %q, expected one of %v", s, Types)
+	}
+	return t, nil
+}
+
+// Entity is a value found within text, normalized so the same value written differently is found once.
+type Entity struct {
+	Type  Type   `json:"type"`
+	Value string `json:"value"`
+}
+
+var (
+	urlRe   = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'` + "`" + `]+`)
+	emailRe = regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,}\b`)
+	// phone numbers need separators between their groups of digits, so they aren't confused with other long numbers
+	phoneRe = regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\)[ .-]?|\b\d{2,4}[ .-])\d{3,4}[ .-]?\d{3,4}\b`)
+	ipv4Re  = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Re  = regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}`)
+	isoRe   = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	// numeric dates are assumed to have the month first, unless it's day can't be a month
+	numericDateRe = regexp.MustCompile(`\b(\d{1,2})[/.](\d{1,2})[/.](\d{4}|\d{2})\b`)
+	monthDayRe    = regexp.MustCompile(`(?i)\b(` + monthNames + `)[a-z]*\.? (\d{1,2})(?:st|nd|rd|th)?,? (\d{4})\b`)
+	dayMonthRe    = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)? (` + monthNames + `)[a-z]*\.?,? (\d{4})\b`)
+	moneyRe       = regexp.MustCompile(`(?:[$€£¥₹]|\b(?:` + currencyCodes + `) ?)\d{1,3}(?:[, ]?\d{3})*(?:[.,]\d{2})?\b|\b\d{1,3}(?:[, ]?\d{3})*(?:[.,]\d{2})? ?(?:[€]|(?:` + currencyCodes + `)\b)`)
+)
+
+const (
+	monthNames    = "jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec"
+	currencyCodes = "USD|EUR|GBP|JPY|CNY|INR|CAD|AUD|CHF|SEK|NOK|DKK|MXN|BRL"
+)
+
+// Extract returns the entities within text, each only once.
+func Extract(text string) []Entity {
+	var found []Entity
+	add := func(t Type, value string) {
+		e := Entity{Type: t, Value: value}
+		if value != "" && !slices.Contains(found, e) {
+			found = append(found, e)
+		}
+	}
+
+	for _, u := range urlRe.FindAllString(text, -1) {
+		add(URL, strings.TrimRight(u, ".,;:!?)]}'\""))
+	}
+	for _, e := range emailRe.FindAllString(text, -1) {
+		add(Email, strings.ToLower(e))
+	}
+	for _, loc := range phoneRe.FindAllStringIndex(text, -1) {
+		if !partOfLongerNumber(text, loc[0], loc[1]) {
+			add(Phone, normalizePhone(text[loc[0]:loc[1]]))
+		}
+	}
+	for _, ip := range append(ipv4Re.FindAllString(text, -1), ipv6Re.FindAllString(text, -1)...) {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			add(IP, addr.String())
+		}
+	}
+	for _, m := range isoRe.FindAllStringSubmatch(text, -1) {
+		add(Date, formatDate(m[1], m[2], m[3]))
+	}
+	for _, m := range numericDateRe.FindAllStringSubmatch(text, -1) {
+		month, day := m[1], m[2]
+		if n, _ := strconv.Atoi(month); n > 12 {
+			month, day = day, month
+		}
+		add(Date, formatDate(m[3], month, day))
+	}
+	for _, m := range monthDayRe.FindAllStringSubmatch(text, -1) {
+		add(Date, formatDate(m[3], monthNumber(m[1]), m[2]))
+	}
+	for _, m := range dayMonthRe.FindAllStringSubmatch(text, -1) {
+		add(Date, formatDate(m[3], monthNumber(m[2]), m[1]))
+	}
+	for _, m := range moneyRe.FindAllString(text, -1) {
+		add(Money, strings.TrimSpace(m))
+	}
+	return found
+}
+
+// normalizePhone keeps only the digits of a phone number, and the + of an international one.
+// Numbers with too few or many digits to be phone numbers are dropped.
+func normalizePhone(p string) string {
+	var b strings.Builder
+	if strings.HasPrefix(p, "+") {
+		b.WriteByte('+')
+	}
+	digits := 0
+	for _, r := range p {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			digits++
+		}
+	}
+	if digits < 7 || digits > 15 {
+		return ""
+	}
+	return b.String()
+}
+
+// partOfLongerNumber reports whether the phone number at text[start:end] is really part of another number,
+// either hyphenated onto more digits like an ISBN, or among groups of digits that make up a card number.
+func partOfLongerNumber(text string, start, end int) bool {
+	isDigit := func(i int) bool { return i >= 0 && i < len(text) && text[i] >= '0' && text[i] <= '9' }
+	isHyphen := func(i int) bool { return i >= 0 && i < len(text) && text[i] == '-' }
+	isSep := func(i int) bool { return isHyphen(i) || i >= 0 && i < len(text) && text[i] == ' ' }
+	if isHyphen(start-1) && isDigit(start-2) || isHyphen(end) && isDigit(end+1) {
+		return true
+	}
+
+	// widen the match to the digits and single separators around it
+	for ; isDigit(start-1) || isSep(start-1) && isDigit(start-2); start-- {
+	}
+	for ; isDigit(end) || isSep(end) && isDigit(end+1); end++ {
+	}
+	var digits []int
+	for _, r := range text[start:end] {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+	return len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits)
+}
+
+// luhnValid reports whether digits end in a valid Luhn check digit, as card numbers do.
+func luhnValid(digits []int) bool {
+	sum := 0
+	for i, d := range slices.Backward(digits) {
+		if (len(digits)-1-i)%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func monthNumber(name string) string {
+	return strconv.Itoa(strings.Index(monthNames, strings.ToLower(name[:3]))/4 + 1)
+}
+
+// formatDate formats a date as 2006-01-02, or returns an empty string if it isn't a real date. Two digit years are in this century.
+func formatDate(year, month, day string) string {
+	y, _ := strconv.Atoi(year)
+	m, _ := strconv.Atoi(month)
+	d, _ := strconv.Atoi(day)
+	if len(year) == 2 {
+		y += 2000
+	}
+	t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	// time.Date normalizes dates like February 30th into March instead of failing
+	if t.Year() != y || t.Month() != time.Month(m) || t.Day() != d {
+		return ""
+	}
+	return t.Format(time.DateOnly)
+}
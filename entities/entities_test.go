@@ -0,0 +1,64 @@
+package entities
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Entity
+	}{
+		{"url", "see https://example.com/a?b=1. and www.test.org/x)", []Entity{{URL, "https://example.com/a?b=1"}, {URL, "www.test.org/x"}}},
+		{"url once", "http://a.io http://a.io", []Entity{{URL, "http://a.io"}}},
+
+		{"email", "mail Bob.Smith+tag@Example.co.uk!", []Entity{{Email, "bob.smith+tag@example.co.uk"}}},
+		{"email without a domain", "not@home", nil},
+
+		{"phone", "call 555-123-4567 now", []Entity{{Phone, "5551234567"}}},
+		{"phone with dots", "tel 555.123.4567.", []Entity{{Phone, "5551234567"}}},
+		{"international phone", "+1 (555) 123-4567", []Entity{{Phone, "+15551234567"}}},
+		{"international phone with spaces", "+44 20 7946 0958", []Entity{{Phone, "+442079460958"}}},
+		{"phone with area code", "(02) 9876 5432", []Entity{{Phone, "0298765432"}}},
+		{"number without separators", "order 12345678", nil},
+		{"card number", "4111 1111 1111 1111", nil},
+		{"hyphenated card number", "4111-1111-1111-1111", nil},
+		{"ISBN", "ISBN 978-3-16-148410-0", nil},
+
+		{"ip", "10.0.0.1 and fe80::1 and 2001:db8::8a2e:370:7334", []Entity{{IP, "10.0.0.1"}, {IP, "fe80::1"}, {IP, "2001:db8::8a2e:370:7334"}}},
+		{"invalid ip", "999.1.1.1 and 12:30:45", nil},
+
+		{"iso date", "2024-02-29 but not 2024-02-30", []Entity{{Date, "2024-02-29"}}},
+		{"numeric date", "03/04/2024", []Entity{{Date, "2024-03-04"}}},
+		{"numeric date with the day first", "25.12.23", []Entity{{Date, "2023-12-25"}}},
+		{"month first", "Jan 5th, 2024 and Sept. 9 2023", []Entity{{Date, "2024-01-05"}, {Date, "2023-09-09"}}},
+		{"day first", "5 March 2024", []Entity{{Date, "2024-03-05"}}},
+
+		{"money", "$1,234.56 €5 £3.50 ¥1000", []Entity{{Money, "$1,234.56"}, {Money, "€5"}, {Money, "£3.50"}, {Money, "¥1000"}}},
+		{"currency codes", "10 EUR and USD 20", []Entity{{Money, "10 EUR"}, {Money, "USD 20"}}},
+		{"number without a currency", "42.00", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Extract(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("Extract(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseType(t *testing.T) {
+	for _, typ := range Types {
+		if got, err := ParseType(string(typ)); err != nil || got != typ {
+			t.Errorf("ParseType(%s) = %s, %v", typ, got, err)
+		}
+	}
+	if got, err := ParseType("Phone"); err != nil || got != Phone {
+		t.Errorf("ParseType(Phone) = %s, %v", got, err)
+	}
+	if _, err := ParseType("postcode"); err == nil {
+		t.Error("ParseType of an unknown type succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+// Package events reports what searmage did as JSON Lines, and runs commands in response to it.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Type is what happened to an image.
+type Type string
+
+const (
+	// Indexed is an image whose text was stored.
+	Indexed Type = "indexed"
+	// Failed is an image that couldn't be indexed.
+	Failed Type = "failed"
+	// Pruned is a path removed from the index because it's file was deleted.
+	Pruned Type = "pruned"
+	// Matched is an image that was indexed matching a saved search.
+	Matched Type = "matched"
+)
+
+// Event is something that happened to an image.
+type Event struct {
+	Type    Type      `json:"type"`
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	ImageID int64     `json:"image_id,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	// Text is what was parsed from an Indexed image.
+	Text string `json:"text,omitempty"`
+	// Error is why a Failed image couldn't be indexed.
+	Error string `json:"error,omitempty"`
+	// Search is the name of the saved search a Matched image matched.
+	Search string `json:"search,omitempty"`
+}
+
+// Writer writes events as JSON Lines. It's safe for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewWriter returns a Writer writing events to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, enc: json.NewEncoder(w)}
+}
+
+// Open returns a Writer appending events to the file at path, or writing them to stdout if path is -.
+func Open(path string) (*Writer, error) {
+	if path == "-" {
+		return NewWriter(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.OpenFile")
+	}
+	return NewWriter(f), nil
+}
+
+// Write writes e as a line of JSON.
+func (w *Writer) Write(e Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Wrapf(w.enc.Encode(e), "json.Encode")
+}
+
+// Close closes the file events are written to, unless it's stdout.
+func (w *Writer) Close() error {
+	if c, ok := w.w.(io.Closer); ok && w.w != os.Stdout {
+		return errors.Wrapf(c.Close(), "Close")
+	}
+	return nil
+}
+
+// Run runs command with the shell, describing e to it within SEARMAGE_EVENT_* environment variables and giving it stdin.
+// e.Text is left to stdin, since it may be too long for an environment variable.
+// It's output goes to stderr, so it can't be mistaken for events written to stdout.
+func Run(ctx context.Context, command string, e Event, stdin io.Reader) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(),
+		"SEARMAGE_EVENT_TYPE="+string(e.Type),
+		"SEARMAGE_EVENT_PATH="+e.Path,
+		"SEARMAGE_EVENT_IMAGE_ID="+strconv.FormatInt(e.ImageID, 10),
+		"SEARMAGE_EVENT_HASH="+e.Hash,
+		"SEARMAGE_EVENT_ERROR="+e.Error,
+		"SEARMAGE_EVENT_SEARCH="+e.Search,
+	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, os.Stderr, os.Stderr
+	return errors.Wrapf(cmd.Run(), "%s", command)
+}
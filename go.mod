@@ -7,6 +7,7 @@ require (
 	github.com/danlock/pkg v0.0.33-d8f5e77
 	github.com/ncruces/go-sqlite3 v0.11.1
 	github.com/otiai10/gosseract/v2 v2.4.1
+	golang.org/x/sys v0.15.0
 )
 
 require (
@@ -14,6 +15,5 @@ require (
 	github.com/ncruces/julianday v1.0.0 // indirect
 	github.com/tetratelabs/wazero v1.5.0 // indirect
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
@@ -0,0 +1,74 @@
+// Package hashing identifies images by their content, with hashes prefixed by the algorithm that made them so they can be upgraded later.
+package hashing
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// Algorithm is a content hash, named by the prefix of the hashes it makes such as md5:.
+type Algorithm string
+
+const (
+	MD5    Algorithm = "md5"
+	SHA256 Algorithm = "sha256"
+	// BLAKE2b is BLAKE2b-256, about as fast as MD5 but without it's collisions.
+	BLAKE2b Algorithm = "blake2b"
+	// XXHash is XXH64, the fastest but not meant to resist deliberate collisions.
+	XXHash Algorithm = "xxhash"
+)
+
+// Algorithms lists every supported Algorithm.
+var Algorithms = []Algorithm{MD5, SHA256, BLAKE2b, XXHash}
+
+// Default is what images are hashed with unless configured otherwise. It's kept as MD5 so existing databases keep recognizing copies of their images.
+const Default = MD5
+
+// ParseAlgorithm returns the Algorithm named s.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	for _, a := range Algorithms {
+		if string(a) == s {
+			return a, nil
+		}
+	}
+	return "", errors.Errorf("unknown hash %q, expected one of %v", s, Algorithms)
+}
+
+// Of returns the Algorithm that made a stored hash, according to it's prefix.
+func Of(stored string) Algorithm {
+	alg, _, _ := strings.Cut(stored, ":")
+	return Algorithm(alg)
+}
+
+// New returns a hash.Hash for the Algorithm.
+func (a Algorithm) New() (hash.Hash, error) {
+	switch a {
+	case MD5:
+		return md5.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case BLAKE2b:
+		return newBLAKE2b(32), nil
+	case XXHash:
+		return newXXH64(), nil
+	}
+	return nil, errors.Errorf("unknown hash %q", a)
+}
+
+// Sum reads r until EOF and returns it's hash prefixed by the algorithm, such as md5:<base64>.
+func Sum(a Algorithm, r io.Reader) (string, error) {
+	h, err := a.New()
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	if _, err = io.Copy(h, r); err != nil {
+		return "", errors.Wrapf(err, "io.Copy")
+	}
+	return string(a) + ":" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
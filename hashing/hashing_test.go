@@ -0,0 +1,131 @@
+package hashing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// counting returns n bytes of 0, 1, 2... wrapping at 251, so inputs longer than a block don't repeat on block boundaries.
+func counting(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// checkVector hashes in in one Write and again a byte at a time, since the buffering is where block boundaries go wrong.
+func checkVector(t *testing.T, newHash func() hash.Hash, in []byte, want string) {
+	t.Helper()
+	h := newHash()
+	h.Write(in)
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("len %d: got %s, want %s", len(in), got, want)
+	}
+
+	h.Reset()
+	for _, c := range in {
+		h.Write([]byte{c})
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("len %d a byte at a time: got %s, want %s", len(in), got, want)
+	}
+}
+
+func TestBLAKE2b(t *testing.T) {
+	// RFC 7693 Appendix A
+	t.Run("RFC 7693 BLAKE2b-512", func(t *testing.T) {
+		checkVector(t, func() hash.Hash { return newBLAKE2b(64) }, []byte("abc"),
+			"ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923")
+	})
+
+	// BLAKE2b-256 as computed by the reference implementation, spanning the 128 byte block size
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte(""), "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{[]byte("abc"), "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{[]byte("The quick brown fox jumps over the lazy dog"), "01718cec35cd3d796dd00020e0bfecb473ad23457d063b75eff29c0ffa2e58a9"},
+		{counting(127), "f2fe67ff342e21b8f45e8f2e0bcd1d9243245d50ee6c78042e9c491388791c72"},
+		{counting(128), "c3582f71ebb2be66fa5dd750f80baae97554f3b015663c8be377cfcb2488c1d1"},
+		{counting(129), "f7f3c46ba2564ff4c4c162da1f5b605f9f1c4aa6a20652a9f9a337c1a2f5b9c9"},
+		{counting(256), "582f782226018ec33076bd8d1c42413530ac7e1126260ffc0f306ba3befc3f24"},
+		{counting(1000), "b372d0608f720c8c3dd41e9c8eecb10143b41abe520b616607e754bf79c08331"},
+	}
+	for _, tt := range tests {
+		checkVector(t, func() hash.Hash { return newBLAKE2b(32) }, tt.in, tt.want)
+	}
+}
+
+func TestXXH64(t *testing.T) {
+	// the first four are from the xxHash repository and the python-xxhash documentation, the rest span the 32 byte stripe size
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte(""), "ef46db3751d8e999"},
+		{[]byte("a"), "d24ec4f1a98c6e5b"},
+		{[]byte("abc"), "44bc2cf5ad770999"},
+		{[]byte("Nobody inspects the spammish repetition"), "fbcea83c8a378bf1"},
+		{counting(31), "c346d2b59b4d8ee1"},
+		{counting(32), "cbf59c5116ff32b4"},
+		{counting(33), "0c535d1acafb8ead"},
+		{counting(63), "e26aa9e2a95f8e4f"},
+		{counting(64), "f7c67301db6713f0"},
+		{counting(100), "6ac1e58032166597"},
+		{counting(1000), "f306f04aa88b54d3"},
+	}
+	for _, tt := range tests {
+		checkVector(t, func() hash.Hash { return newXXH64() }, tt.in, tt.want)
+	}
+}
+
+func TestSum(t *testing.T) {
+	in := counting(300)
+	for _, alg := range Algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			sum, err := Sum(alg, bytes.NewReader(in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix, encoded, ok := strings.Cut(sum, ":")
+			if !ok || prefix != string(alg) {
+				t.Fatalf("%s isn't prefixed by %s:", sum, alg)
+			}
+			if Of(sum) != alg {
+				t.Errorf("Of(%s) = %s, want %s", sum, Of(sum), alg)
+			}
+			if parsed, err := ParseAlgorithm(prefix); err != nil || parsed != alg {
+				t.Errorf("ParseAlgorithm(%s) = %s, %v", prefix, parsed, err)
+			}
+
+			h, _ := alg.New()
+			h.Write(in)
+			digest, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(digest, h.Sum(nil)) {
+				t.Errorf("%s doesn't encode the digest %x", sum, h.Sum(nil))
+			}
+
+			// Sum copies in whatever chunks the reader gives
+			if oneByte, err := Sum(alg, iotest.OneByteReader(bytes.NewReader(in))); err != nil || oneByte != sum {
+				t.Errorf("reading a byte at a time got %s, %v, want %s", oneByte, err, sum)
+			}
+		})
+	}
+
+	if _, err := Sum("crc32", bytes.NewReader(in)); err == nil {
+		t.Error("Sum with an unknown algorithm succeeded")
+	}
+	if _, err := ParseAlgorithm("crc32"); err == nil {
+		t.Error("ParseAlgorithm of an unknown algorithm succeeded")
+	}
+}
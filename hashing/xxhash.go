@@ -0,0 +1,98 @@
+package hashing
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxh64 implements XXH64 with a seed of 0 from https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md,
+// since no xxhash package is a dependency.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func newXXH64() *xxh64 {
+	d := &xxh64{}
+	d.Reset()
+	return d
+}
+
+func (d *xxh64) Reset() {
+	// the seed is a variable so the sums wrap around instead of overflowing as constants
+	var seed uint64
+	d.v = [4]uint64{seed + xxPrime1 + xxPrime2, seed + xxPrime2, seed, seed - xxPrime1}
+	d.total, d.n = 0, 0
+}
+
+func (d *xxh64) Size() int      { return 8 }
+func (d *xxh64) BlockSize() int { return 32 }
+
+func xxRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxPrime2, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	return (acc^xxRound(0, v))*xxPrime1 + xxPrime4
+}
+
+func (d *xxh64) Write(p []byte) (int, error) {
+	written := len(p)
+	d.total += uint64(len(p))
+	for len(p) > 0 {
+		copied := copy(d.buf[d.n:], p)
+		d.n += copied
+		p = p[copied:]
+		if d.n == len(d.buf) {
+			for i := range d.v {
+				d.v[i] = xxRound(d.v[i], binary.LittleEndian.Uint64(d.buf[i*8:]))
+			}
+			d.n = 0
+		}
+	}
+	return written, nil
+}
+
+func (d *xxh64) Sum(b []byte) []byte {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v[0], 1) + bits.RotateLeft64(d.v[1], 7) + bits.RotateLeft64(d.v[2], 12) + bits.RotateLeft64(d.v[3], 18)
+		for _, v := range d.v {
+			h = xxMerge(h, v)
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += d.total
+
+	rest := d.buf[:d.n]
+	for ; len(rest) >= 8; rest = rest[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(rest))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(rest) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(rest)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		rest = rest[4:]
+	}
+	for _, c := range rest {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return binary.BigEndian.AppendUint64(b, h)
+}
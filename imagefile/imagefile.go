@@ -0,0 +1,106 @@
+// Package imagefile opens the images searmage parses, whether they're files or entries within ZIP archives.
+package imagefile
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// ArchiveSep separates the path of an archive from the name of an entry within it, as in comics.cbz!/page01.png.
+const ArchiveSep = "!/"
+
+// IsImage reports whether fPath has the extension of an image we can parse.
+func IsImage(fPath string) bool {
+	switch strings.ToLower(path.Ext(fPath)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// IsArchive reports whether fPath has the extension of an archive whose images we can parse.
+func IsArchive(fPath string) bool {
+	switch strings.ToLower(path.Ext(fPath)) {
+	case ".zip", ".cbz":
+		return true
+	}
+	return false
+}
+
+// SplitArchivePath splits the path of an entry within an archive into the archive's path and the entry's name.
+// ok is false for paths that aren't within an archive.
+func SplitArchivePath(fPath string) (archive, entry string, ok bool) {
+	archive, entry, ok = strings.Cut(fPath, ArchiveSep)
+	if !ok || !IsArchive(archive) {
+		return fPath, "", false
+	}
+	return archive, entry, true
+}
+
+// Entry is an image within an archive.
+type Entry struct {
+	// Path is the archive's path joined to the entry's name with ArchiveSep.
+	Path string
+	*zip.File
+}
+
+// ArchiveImages lists the images within the archive, skipping the resource forks macOS leaves in ZIPs.
+func ArchiveImages(archive string) ([]Entry, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zip.OpenReader")
+	}
+	defer zr.Close()
+
+	var entries []Entry
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !IsImage(f.Name) || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(path.Base(f.Name), "._") {
+			continue
+		}
+		entries = append(entries, Entry{Path: archive + ArchiveSep + f.Name, File: f})
+	}
+	return entries, nil
+}
+
+// ReadSeekCloser is an opened image.
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Open opens the image at fPath. Entries within archives are read into memory, since they can't be seeked within the archive.
+func Open(fPath string) (ReadSeekCloser, error) {
+	archive, entry, ok := SplitArchivePath(fPath)
+	if !ok {
+		f, err := os.Open(fPath)
+		return f, errors.Wrapf(err, "os.Open")
+	}
+
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zip.OpenReader")
+	}
+	defer zr.Close()
+
+	f, err := zr.Open(entry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zr.Open")
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "io.ReadAll")
+	}
+	return nopCloser{bytes.NewReader(buf)}, nil
+}
+
+type nopCloser struct{ *bytes.Reader }
+
+func (nopCloser) Close() error { return nil }
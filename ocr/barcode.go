@@ -0,0 +1,23 @@
+package ocr
+
+import (
+	"image"
+	"log/slog"
+
+	"github.com/danlock/searmage/barcode"
+)
+
+// scanCodes returns the text of the QR codes and barcodes within the image, empty but not nil if there are none.
+// It's nil if the image couldn't be decoded, so the image is scanned again next time.
+func scanCodes(name string, img image.Image) []string {
+	if img == nil {
+		return nil
+	}
+	codes := barcode.ScanImage(img)
+	texts := make([]string, len(codes))
+	for i, c := range codes {
+		texts[i] = c.Text
+		slog.Debug("found barcode", "path", name, "format", c.Format, "text", c.Text)
+	}
+	return texts
+}
@@ -0,0 +1,54 @@
+package ocr
+
+import (
+	"image"
+	"io"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// DHash decodes a JPEG or PNG image and returns it's perceptual hash, see dHash.
+func DHash(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, errors.Wrapf(err, "image.Decode")
+	}
+	return dHash(img), nil
+}
+
+// dHash is a difference hash, which shrinks the image to 9x8 grayscale pixels and sets a bit whenever a pixel is brighter than the one to it's right.
+// Resizing or recompressing an image barely changes it, so copies are within a few bits of each other.
+// https://www.hackerfactor.com/blog/index.php?/archives/529-Kind-of-Like-That.html
+func dHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+
+	var cells [h][w]float64
+	var counts [h][w]int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * w / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			// Rec. 601 luma
+			cells[cy][cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			counts[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := range h {
+		for x := range w - 1 {
+			// images narrower than 9 pixels leave some cells empty, which count as black
+			left, right := cells[y][x]/float64(max(1, counts[y][x])), cells[y][x+1]/float64(max(1, counts[y][x+1]))
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
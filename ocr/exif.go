@@ -0,0 +1,301 @@
+package ocr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/db"
+)
+
+// decodeImage decodes img once for the thumbnail, metadata and barcodes, returning nil if it can't be decoded.
+// Failures are only logged, since the text is what matters and Tesseract reads the image itself.
+func decodeImage(name string, img io.ReadSeeker) (decoded image.Image, format string) {
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		slog.Warn("failed decoding image", "path", name, "err", err)
+		return nil, ""
+	}
+	decoded, format, err := image.Decode(img)
+	if err != nil {
+		slog.Warn("failed decoding image", "path", name, "err", err)
+		return nil, ""
+	}
+	return decoded, format
+}
+
+// makeMetadata reads the decoded image's format, size, perceptual hash and EXIF. Failures are only logged, since the text is what matters.
+func makeMetadata(name string, img io.ReadSeeker, decoded image.Image, format string) *db.Metadata {
+	if decoded == nil {
+		return nil
+	}
+	md, err := readMetadata(img, decoded, format)
+	if err != nil {
+		slog.Warn("failed reading image metadata", "path", name, "err", err)
+		return nil
+	}
+	return md
+}
+
+// readMetadata takes the image's format, size and perceptual hash from it's decoded form, then reads it's EXIF if it has any.
+// Broken EXIF is ignored, since cameras and editors write plenty of it.
+func readMetadata(img io.ReadSeeker, decoded image.Image, format string) (*db.Metadata, error) {
+	bounds := decoded.Bounds()
+	md := &db.Metadata{Format: format, Width: bounds.Dx(), Height: bounds.Dy(), DHash: db.FormatDHash(dHash(decoded))}
+
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "img.Seek")
+	}
+	var tiff []byte
+	var err error
+	switch format {
+	case "jpeg":
+		tiff, err = jpegEXIF(img)
+	case "png":
+		tiff, err = pngEXIF(img)
+	}
+	if err != nil {
+		slog.Debug("failed finding EXIF", "err", err)
+	} else if tiff != nil {
+		if err = parseEXIF(tiff, md); err != nil {
+			slog.Debug("failed parsing EXIF", "err", err)
+		}
+	}
+	return md, nil
+}
+
+// maxEXIFSize is as big as EXIF gets within a JPEG, since it must fit in a single APP1 segment.
+const maxEXIFSize = 64 << 10
+
+// jpegEXIF returns the TIFF structure within the JPEG's APP1 segment, or nil if there isn't one.
+func jpegEXIF(r io.ReadSeeker) ([]byte, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, errors.Wrapf(err, "io.ReadFull")
+	}
+	for {
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return nil, errors.Wrapf(err, "io.ReadFull")
+		}
+		if buf[0] != 0xff {
+			return nil, errors.Errorf("invalid JPEG marker %x", buf[:2])
+		}
+		marker := buf[1]
+		// SOS starts the image data, and EXIF always comes before it
+		if marker == 0xda || marker == 0xd9 {
+			return nil, nil
+		}
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return nil, errors.Wrapf(err, "io.ReadFull")
+		}
+		size := int64(binary.BigEndian.Uint16(buf[:2])) - 2
+		if size < 0 {
+			return nil, errors.Errorf("invalid JPEG segment size %d", size)
+		}
+		if marker != 0xe1 {
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return nil, errors.Wrapf(err, "r.Seek")
+			}
+			continue
+		}
+
+		seg := make([]byte, size)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, errors.Wrapf(err, "io.ReadFull")
+		}
+		// APP1 may hold XMP instead
+		if tiff, ok := bytes.CutPrefix(seg, []byte("Exif\x00\x00")); ok {
+			return tiff, nil
+		}
+	}
+}
+
+// pngEXIF returns the contents of the PNG's eXIf chunk, or nil if there isn't one.
+func pngEXIF(r io.ReadSeeker) ([]byte, error) {
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "r.Seek")
+	}
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errors.Wrapf(err, "io.ReadFull")
+		}
+		size, chunk := binary.BigEndian.Uint32(header[:4]), string(header[4:])
+		switch {
+		case chunk == "eXIf" && size <= maxEXIFSize:
+			tiff := make([]byte, size)
+			_, err := io.ReadFull(r, tiff)
+			return tiff, errors.Wrapf(err, "io.ReadFull")
+		case chunk == "IEND":
+			return nil, nil
+		}
+		// skip the chunk and it's CRC
+		if _, err := r.Seek(int64(size)+4, io.SeekCurrent); err != nil {
+			return nil, errors.Wrapf(err, "r.Seek")
+		}
+	}
+}
+
+// EXIF tags we read, from https://exiftool.org/TagNames/EXIF.html and https://exiftool.org/TagNames/GPS.html
+const (
+	tagMake              = 0x010f
+	tagModel             = 0x0110
+	tagOrientation       = 0x0112
+	tagDateTime          = 0x0132
+	tagExifIFD           = 0x8769
+	tagGPSIFD            = 0x8825
+	tagDateTimeOriginal  = 0x9003
+	tagDateTimeDigitized = 0x9004
+
+	tagGPSLatitudeRef  = 1
+	tagGPSLatitude     = 2
+	tagGPSLongitudeRef = 3
+	tagGPSLongitude    = 4
+)
+
+// tiffTypeSizes is the size of each TIFF field type in bytes, indexed by type. Unknown types are 0.
+var tiffTypeSizes = [...]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// tiffField is an IFD entry with it's value's bytes.
+type tiffField struct {
+	typ   uint16
+	count int
+	value []byte
+}
+
+// tiffReader reads IFDs from a TIFF structure, checking every offset against it's bounds.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// parseEXIF fills md with the EXIF within the TIFF structure.
+func parseEXIF(tiff []byte, md *db.Metadata) error {
+	if len(tiff) < 8 {
+		return errors.New("EXIF too short")
+	}
+	t := tiffReader{data: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errors.Errorf("invalid TIFF byte order %q", tiff[:2])
+	}
+	if t.order.Uint16(tiff[2:]) != 42 {
+		return errors.New("invalid TIFF magic number")
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(tiff[4:]))
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	md.CameraMake = t.ascii(ifd0[tagMake])
+	md.CameraModel = t.ascii(ifd0[tagModel])
+	if o, ok := t.uint(ifd0[tagOrientation]); ok && o >= 1 && o <= 8 {
+		md.Orientation = int(o)
+	}
+
+	dates := []string{t.ascii(ifd0[tagDateTime])}
+	if off, ok := t.uint(ifd0[tagExifIFD]); ok {
+		if exif, err := t.ifd(off); err == nil {
+			dates = append([]string{t.ascii(exif[tagDateTimeOriginal]), t.ascii(exif[tagDateTimeDigitized])}, dates...)
+		}
+	}
+	for _, d := range dates {
+		// unknown parts of EXIF dates are sometimes blanked out with spaces or zeros, which don't parse
+		if taken, err := time.Parse("2006:01:02 15:04:05", d); err == nil {
+			md.TakenAt = taken.Format(db.TakenAtLayout)
+			break
+		}
+	}
+
+	if off, ok := t.uint(ifd0[tagGPSIFD]); ok {
+		if gps, err := t.ifd(off); err == nil {
+			lat, latOK := t.degrees(gps[tagGPSLatitude], t.ascii(gps[tagGPSLatitudeRef]), "S")
+			lon, lonOK := t.degrees(gps[tagGPSLongitude], t.ascii(gps[tagGPSLongitudeRef]), "W")
+			if latOK && lonOK {
+				md.Latitude, md.Longitude = &lat, &lon
+			}
+		}
+	}
+	return nil
+}
+
+// ifd reads the entries of the IFD at off. Entries with unknown types or out of bounds values are skipped.
+func (t tiffReader) ifd(off uint32) (map[uint16]tiffField, error) {
+	if int64(off)+2 > int64(len(t.data)) {
+		return nil, errors.Errorf("IFD offset %d out of bounds", off)
+	}
+	count := int(t.order.Uint16(t.data[off:]))
+	entries := t.data[off+2:]
+	if count*12 > len(entries) {
+		return nil, errors.Errorf("IFD at %d has %d entries, more than fit", off, count)
+	}
+
+	fields := make(map[uint16]tiffField, count)
+	for i := range count {
+		e := entries[i*12 : i*12+12]
+		tag, typ, n := t.order.Uint16(e), t.order.Uint16(e[2:]), t.order.Uint32(e[4:])
+		if int(typ) >= len(tiffTypeSizes) || tiffTypeSizes[typ] == 0 {
+			continue
+		}
+		size := int64(tiffTypeSizes[typ]) * int64(n)
+		// values that fit in 4 bytes are stored in place of their offset
+		value := e[8:12]
+		if size > 4 {
+			valueOff := int64(t.order.Uint32(e[8:]))
+			if valueOff+size > int64(len(t.data)) {
+				continue
+			}
+			value = t.data[valueOff : valueOff+size]
+		}
+		fields[tag] = tiffField{typ: typ, count: int(n), value: value[:size]}
+	}
+	return fields, nil
+}
+
+// ascii returns an ASCII field's text without it's NUL terminator or padding.
+func (t tiffReader) ascii(f tiffField) string {
+	if f.typ != 2 {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(f.value), "\x00")
+	return strings.TrimSpace(s)
+}
+
+// uint returns the first value of a SHORT or LONG field.
+func (t tiffReader) uint(f tiffField) (uint32, bool) {
+	switch {
+	case f.typ == 3 && f.count > 0:
+		return uint32(t.order.Uint16(f.value)), true
+	case f.typ == 4 && f.count > 0:
+		return t.order.Uint32(f.value), true
+	}
+	return 0, false
+}
+
+// degrees converts a GPS coordinate stored as degrees, minutes and seconds RATIONALs into decimal degrees,
+// negative if ref is the negative hemisphere.
+func (t tiffReader) degrees(f tiffField, ref, negativeRef string) (float64, bool) {
+	if f.typ != 5 || f.count != 3 {
+		return 0, false
+	}
+	var deg float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, denom := t.order.Uint32(f.value[i*8:]), t.order.Uint32(f.value[i*8+4:])
+		if denom == 0 {
+			return 0, false
+		}
+		deg += float64(num) / float64(denom) / unit
+	}
+	if ref == negativeRef {
+		deg = -deg
+	}
+	return deg, true
+}
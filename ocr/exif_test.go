@@ -0,0 +1,119 @@
+package ocr
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"testing"
+
+	"github.com/danlock/searmage/db"
+)
+
+// The fixtures are 8x6 images with hand built EXIF:
+// exif-ii.jpg is little endian after an XMP APP1, with DateTimeOriginal, DateTimeDigitized and DateTime, and GPS in the N and E hemispheres.
+// exif-mm.png is big endian in an eXIf chunk, with DateTimeOriginal blanked out by spaces, and GPS in the S and W hemispheres.
+// exif-truncated.jpg has an IFD0 claiming more entries than fit.
+var (
+	//go:embed testdata/exif-ii.jpg
+	exifII []byte
+	//go:embed testdata/exif-mm.png
+	exifMM []byte
+	//go:embed testdata/exif-truncated.jpg
+	exifTruncated []byte
+)
+
+// readFixture reads the metadata of an image like the parser does.
+func readFixture(t *testing.T, data []byte) *db.Metadata {
+	t.Helper()
+	decoded, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := readMetadata(bytes.NewReader(data), decoded, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md
+}
+
+func TestReadMetadata(t *testing.T) {
+	lat, lon := 40+26/60.+46.32/3600, 79+58/60.+56/3600.
+	south, west := -(33 + 52/60.), -(151 + 12/60. + 30/3600.)
+	tests := []struct {
+		name     string
+		data     []byte
+		want     db.Metadata
+		lat, lon *float64
+	}{
+		{
+			name: "little endian JPEG",
+			data: exifII,
+			// DateTimeOriginal is preferred over when the file was last changed
+			want: db.Metadata{Format: "jpeg", Width: 8, Height: 6, TakenAt: "2021-07-04T12:30:15", CameraMake: "Canon", CameraModel: "Canon EOS 5D", Orientation: 6},
+			lat:  &lat, lon: &lon,
+		},
+		{
+			name: "big endian PNG",
+			data: exifMM,
+			// the blanked out DateTimeOriginal falls back to DateTime
+			want: db.Metadata{Format: "png", Width: 8, Height: 6, TakenAt: "2019-12-31T23:59:59", CameraMake: "NIKON CORPORATION", CameraModel: "NIKON D750", Orientation: 3},
+			lat:  &south, lon: &west,
+		},
+		{
+			name: "truncated IFD",
+			data: exifTruncated,
+			want: db.Metadata{Format: "jpeg", Width: 8, Height: 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := readFixture(t, tt.data)
+			checkLocation(t, md, tt.lat, tt.lon)
+			md.Latitude, md.Longitude, md.DHash = nil, nil, ""
+			if *md != tt.want {
+				t.Errorf("got %+v, want %+v", *md, tt.want)
+			}
+		})
+	}
+}
+
+func checkLocation(t *testing.T, md *db.Metadata, lat, lon *float64) {
+	t.Helper()
+	if (md.Latitude == nil) != (lat == nil) || (md.Longitude == nil) != (lon == nil) {
+		t.Fatalf("got location %v, %v, want %v, %v", md.Latitude, md.Longitude, lat, lon)
+	}
+	if lat != nil && (math.Abs(*md.Latitude-*lat) > 1e-9 || math.Abs(*md.Longitude-*lon) > 1e-9) {
+		t.Errorf("got location %f, %f, want %f, %f", *md.Latitude, *md.Longitude, *lat, *lon)
+	}
+}
+
+func TestParseEXIFTruncated(t *testing.T) {
+	tiff, err := jpegEXIF(bytes.NewReader(exifII))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tiffReader{data: tiff, order: binary.LittleEndian}
+	ifd0, err := tr.ifd(tr.order.Uint32(tiff[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpsOff, _ := tr.uint(ifd0[tagGPSIFD])
+
+	// cutting off the GPS IFD, which comes last, loses the location but nothing else
+	var md db.Metadata
+	if err = parseEXIF(tiff[:gpsOff+1], &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Latitude != nil || md.CameraMake != "Canon" || md.TakenAt != "2021-07-04T12:30:15" {
+		t.Errorf("got %+v", md)
+	}
+
+	// and no amount of truncation reads out of bounds
+	for n := range len(tiff) {
+		parseEXIF(tiff[:n], &db.Metadata{})
+	}
+}
@@ -0,0 +1,124 @@
+package ocr
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/db"
+)
+
+// parseHOCR extracts the words and their bounding boxes from Tesseract's hOCR output. https://kba.github.io/hocr-spec/1.2/
+// The text is rebuilt from the words, with a line per ocr_line and a blank line between paragraphs, like Tesseract's plain text output.
+func parseHOCR(hocr string) (text string, words []db.WordBox, err error) {
+	dec := xml.NewDecoder(strings.NewReader(hocr))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	var word *db.WordBox
+	// depth tracks nesting within the current word, since Tesseract may wrap it in <strong> or <em>
+	depth := 0
+	lineHasWords := false
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, errors.Wrapf(err, "dec.Token")
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if word != nil {
+				depth++
+				continue
+			}
+			switch attr(t, "class") {
+			case "ocr_par":
+				if b.Len() > 0 {
+					b.WriteString("\n")
+				}
+			case "ocr_line", "ocr_caption", "ocr_header", "ocr_textfloat":
+				lineHasWords = false
+			case "ocrx_word":
+				w, ok := parseBBox(attr(t, "title"))
+				if ok {
+					word = &w
+					depth = 0
+				}
+			}
+		case xml.CharData:
+			if word != nil {
+				word.Text += string(t)
+			}
+		case xml.EndElement:
+			if word == nil {
+				if t.Name.Local == "span" && lineHasWords {
+					// a line's span ends after it's words
+					b.WriteString("\n")
+					lineHasWords = false
+				}
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			word.Text = strings.TrimSpace(word.Text)
+			if word.Text != "" {
+				if lineHasWords {
+					b.WriteString(" ")
+				}
+				b.WriteString(word.Text)
+				lineHasWords = true
+				words = append(words, *word)
+			}
+			word = nil
+		}
+	}
+	return b.String(), words, nil
+}
+
+func attr(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// parseBBox reads the properties of an ocrx_word's title, like "bbox 4 1 78 18; x_wconf 95".
+func parseBBox(title string) (w db.WordBox, ok bool) {
+	for _, prop := range strings.Split(title, ";") {
+		fields := strings.Fields(prop)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "bbox":
+			if len(fields) != 5 {
+				return w, false
+			}
+			coords := make([]int, 4)
+			for i, f := range fields[1:] {
+				c, err := strconv.Atoi(f)
+				if err != nil {
+					return w, false
+				}
+				coords[i] = c
+			}
+			w.X0, w.Y0, w.X1, w.Y1 = coords[0], coords[1], coords[2], coords[3]
+			ok = true
+		case "x_wconf":
+			if len(fields) == 2 {
+				w.Confidence, _ = strconv.ParseFloat(fields[1], 64)
+			}
+		}
+	}
+	return w, ok
+}
@@ -0,0 +1,116 @@
+package ocr
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// IgnoreFileName is read from every directory searmage walks. It excludes paths using the same syntax as .gitignore.
+const IgnoreFileName = ".searmageignore"
+
+// ignorePattern is a single line from an IgnoreFileName.
+type ignorePattern struct {
+	glob string
+	// negate re-includes paths matched by an earlier pattern, like !keep.png
+	negate bool
+	// dirOnly patterns end with a slash and only match directories
+	dirOnly bool
+	// anchored patterns contain a slash, so they match the path relative to the ignore file instead of any base name
+	anchored bool
+}
+
+// ignoreList is the patterns of an IgnoreFileName within dir.
+type ignoreList struct {
+	dir      string
+	patterns []ignorePattern
+}
+
+// readIgnoreFile parses the IgnoreFileName within dir, returning nil if there isn't one.
+func readIgnoreFile(dir string) (*ignoreList, error) {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "os.Open")
+	}
+	defer f.Close()
+
+	list := ignoreList{dir: dir}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, errors.Errorf("%s has an invalid pattern %q %w", f.Name(), scanner.Text(), err)
+		}
+		p.glob = line
+		list.patterns = append(list.patterns, p)
+	}
+	return &list, errors.Wrapf(scanner.Err(), "scanner.Scan")
+}
+
+// match reports whether rel, a slash separated path relative to the list's dir, is ignored.
+// matched is false if no pattern applied, so ignore lists of parent directories can be consulted first.
+// Later patterns take precedence over earlier ones, just like .gitignore.
+func (l *ignoreList) match(rel string, isDir bool) (ignored, matched bool) {
+	for _, p := range l.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.anchored && !matchGlob(p.glob, rel) || !p.anchored && !matchGlob(p.glob, path.Base(rel)) {
+			continue
+		}
+		ignored, matched = !p.negate, true
+	}
+	return ignored, matched
+}
+
+// matchGlob is path.Match, except ** matches any number of directories, like a/**/b.png.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// ** can consume any number of name segments, including none
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
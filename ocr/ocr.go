@@ -1,122 +1,307 @@
 package ocr
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	_ "embed"
-	"io/fs"
+	"io"
 	"log/slog"
 	"os"
-	"path"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/danlock/pkg/errors"
-	"github.com/danlock/searmage/cfg"
 	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/hashing"
+	"github.com/danlock/searmage/imagefile"
 )
 
 //go:embed eng.traineddata
 var engTrainedData []byte
 
-type WorkerFunc func(ctx context.Context, errChan chan<- error, img *os.File) error
+// WorkerFunc parses an image and stores it's text under the file's path.
+type WorkerFunc func(ctx context.Context, file db.ImageFile, img io.ReadSeeker) error
 
-func Parse(ctx context.Context, args cfg.Args) error {
-	start := time.Now()
+// queuedImage is an opened image waiting for a worker.
+type queuedImage struct {
+	db.ImageFile
+	img imagefile.ReadSeekCloser
+}
 
-	images, err := GetImagePaths(args.ImageDir)
-	if err != nil {
-		return errors.Wrap(err)
+// workerResult is the outcome of a WorkerFunc call.
+type workerResult struct {
+	path string
+	took time.Duration
+	err  error
+}
+
+// filterBatchSize is how many image paths are checked against the database at once.
+// filterBatchInterval flushes smaller batches when images are sparse, so parsing starts promptly.
+const (
+	filterBatchSize     = 1000
+	filterBatchInterval = time.Second
+)
+
+// Options configures a Parser.
+type Options struct {
+	DB    *sql.DB
+	Roots db.Roots
+	// Workers is how many images are parsed at once.
+	Workers uint
+	// TrainedData is the language data Tesseract uses, English if nil.
+	TrainedData io.Reader
+	// ThumbSize is the longest side of the thumbnails generated for images, in pixels. 0 disables them.
+	ThumbSize int
+	// Hash identifies images by their content, hashing.Default if empty.
+	Hash hashing.Algorithm
+	// Barcodes decodes the QR codes and barcodes within images too, including ones parsed before it was set.
+	Barcodes bool
+	// OverwriteEdits parses changed images again even if their text was corrected by hand, see db.FilterParsedImages.
+	OverwriteEdits bool
+	// Walker finds the images within the directories given to ParseDirs.
+	Walker Walker
+	// Progress is where ParseDirs reports how it's going, if set. Terminals get a progress line, anything else periodic logs.
+	Progress io.Writer
+	// OnParsed is called with the path of each image ParseDirs or ParseReader is done with, and why it failed if it did.
+	// It's never called concurrently, so a slow OnParsed holds up the others.
+	OnParsed func(ctx context.Context, path string, err error)
+}
+
+// Parser parses images and stores their text in the database.
+// Setting up Tesseract is slow, so it waits until there's an image to parse and is kept until Close.
+type Parser struct {
+	opts Options
+	// ctx lasts until Close, so the workers outlive the call that set them up.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	process WorkerFunc
+	// parsedMu keeps Options.OnParsed from being called concurrently.
+	parsedMu sync.Mutex
+}
+
+func NewParser(opts Options) *Parser {
+	if opts.Hash == "" {
+		opts.Hash = hashing.Default
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Parser{opts: opts, ctx: ctx, cancel: cancel}
+}
+
+// Close shuts down the workers.
+func (p *Parser) Close() {
+	p.cancel()
+}
+
+func (p *Parser) worker() (WorkerFunc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.process == nil {
+		process, err := setupWorkers(p.ctx, p.opts)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		p.process = process
 	}
+	return p.process, nil
+}
 
-	images, err = db.FilterParsedImages(ctx, args.DB, images)
+// ParseReader parses the image read from r, storing it's text under name.
+func (p *Parser) ParseReader(ctx context.Context, name string, r io.Reader) error {
+	img, ok := r.(io.ReadSeeker)
+	if !ok {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return errors.Wrapf(err, "io.ReadAll")
+		}
+		img = bytes.NewReader(buf)
+	}
+
+	process, err := p.worker()
 	if err != nil {
 		return errors.Wrap(err)
 	}
+	err = process(ctx, db.ImageFile{Path: name}, img)
+	p.onParsed(ctx, name, err)
+	return errors.Wrap(err)
+}
 
-	filteredImageCount := len(images)
-
-	if filteredImageCount == 0 {
-		slog.Info("Found 0 unparsed images within dir", "-dir", args.ImageDir)
-		return nil
+// onParsed calls Options.OnParsed if it's set, one call at a time.
+func (p *Parser) onParsed(ctx context.Context, path string, err error) {
+	if p.opts.OnParsed == nil {
+		return
 	}
+	p.parsedMu.Lock()
+	defer p.parsedMu.Unlock()
+	p.opts.OnParsed(ctx, path, err)
+}
+
+// Report summarizes a ParseDirs call, including percentiles of how long each image took to parse.
+type Report struct {
+	// Found is how many images weren't in the database yet, including the files and archives that couldn't be read, so Parsed and Failed add up to it.
+	Found    int
+	Parsed   int
+	Failed   int
+	Duration time.Duration
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
 
+// ParseDirs parses the images within dirs that aren't in the database yet.
+// Failing to parse an image is logged and counted in the Report instead of stopping the others.
+func (p *Parser) ParseDirs(ctx context.Context, dirs []string) (Report, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	slog.Info("searmage processing...", "count", filteredImageCount, "workers", args.Workers)
-
-	// Generate image files for the Tesseract workers.
-	// By buffering the channel to the amount of workers in the pool,
-	// we ensure we don't open more image files than needed at a time.
-	imgChan := make(chan *os.File, args.Workers)
-	errChan := make(chan error, 1)
+	// Stream unparsed image files to the Tesseract workers while walking, so parsing starts before the walk finishes.
+	// The channel is buffered to the amount of workers in the pool, and we only take as many images as there are workers,
+	// so we don't open more image files than needed at a time.
+	workers := int(max(1, p.opts.Workers))
+	prog := newProgress(p.opts.Progress)
+	defer prog.clear()
+	imgChan := make(chan queuedImage, workers)
+	walkErrChan := make(chan error, 1)
 	go func() {
-		for _, fPath := range images {
-			img, err := os.Open(fPath)
-			if err != nil {
-				errChan <- errors.Wrapf(err, "os.Open")
-				return
-			}
-			select {
-			case <-ctx.Done():
-				img.Close()
-				return
-			case imgChan <- img:
-			}
-		}
+		defer close(imgChan)
+		walkErrChan <- sendUnparsedImages(ctx, p.opts, dirs, imgChan, prog, p.onParsed)
 	}()
 
-	process, err := setupWorkers(ctx, args)
-	if err != nil {
-		return errors.Wrap(err)
-	}
-	parsedImages := 0
+	// resultChan is big enough that workers never block sending their result while we wait on something else.
+	resultChan := make(chan workerResult, workers)
+	var process WorkerFunc
+	queuedImages, finishedImages := 0, 0
+
+	var err error
+loop:
+	for imgChan != nil || walkErrChan != nil || finishedImages < queuedImages {
+		imgs := imgChan
+		if queuedImages-finishedImages >= workers {
+			imgs = nil
+		}
 
-	for {
 		select {
 		case <-ctx.Done():
-			return errors.Wrap(ctx.Err())
-		case err := <-errChan:
+			err = ctx.Err()
+			break loop
+		case <-prog.tick():
+			prog.report()
+		case err = <-walkErrChan:
 			if err != nil {
-				return errors.Wrap(err)
+				break loop
 			}
-			parsedImages++
+			walkErrChan, prog.walking = nil, false
+		case res := <-resultChan:
+			finishedImages++
+			prog.finished(res.path, res.took, res.err)
+			p.onParsed(ctx, res.path, res.err)
 
-		case img := <-imgChan:
-			go process(ctx, errChan, img)
+		case img, ok := <-imgs:
+			if !ok {
+				imgChan = nil
+				continue
+			}
+			if process == nil {
+				if process, err = p.worker(); err != nil {
+					img.img.Close()
+					break loop
+				}
+			}
+			queuedImages++
+			go func() {
+				defer img.img.Close()
+				start := time.Now()
+				err := process(ctx, img.ImageFile, img.img)
+				resultChan <- workerResult{path: img.Path, took: time.Since(start), err: err}
+			}()
 		}
+	}
 
-		if parsedImages == filteredImageCount {
-			break
+	// If we stopped early, stop the walk and close the images it already opened, then wait for the workers,
+	// so no image is left open and nothing is still parsing once ParseDirs returns.
+	cancel()
+	if imgChan != nil {
+		for img := range imgChan {
+			img.img.Close()
 		}
 	}
-
-	slog.Info("Finished parsing", "count", parsedImages, "duration", time.Since(start))
-	return nil
+	for ; finishedImages < queuedImages; finishedImages++ {
+		res := <-resultChan
+		prog.finished(res.path, res.took, res.err)
+		p.onParsed(ctx, res.path, res.err)
+	}
+	return prog.summary(), errors.Wrap(err)
 }
 
-func GetImagePaths(dir string) ([]string, error) {
-	var imagePaths []string
-	err := filepath.WalkDir(dir, func(fPath string, d fs.DirEntry, err error) error {
+// sendUnparsedImages walks dirs, filtering out images already in the database in batches, and sends the rest to imgChan.
+// The images within archives are sent as entries, such as comics.cbz!/page01.png.
+// Images that can't be opened are counted as failures and passed to onFailed instead of stopping the walk.
+func sendUnparsedImages(ctx context.Context, opts Options, dirs []string, imgChan chan<- queuedImage, prog *progress, onFailed func(context.Context, string, error)) error {
+	batch := make([]db.ImageFile, 0, filterBatchSize)
+	lastFlush := time.Now()
+	failed := func(msg, path string, err error) {
+		prog.failed.Add(1)
+		slog.Warn(msg, "path", path, "err", err)
+		onFailed(ctx, path, err)
+	}
+
+	flush := func() error {
+		unparsed, err := db.FilterParsedImages(ctx, opts.DB, opts.Roots, batch, opts.Barcodes, opts.OverwriteEdits)
 		if err != nil {
-			return errors.Wrapf(err, "filepath.WalkDir os.Open")
+			return errors.Wrap(err)
 		}
+		batch, lastFlush = batch[:0], time.Now()
 
-		if d.IsDir() {
-			return nil
+		prog.found.Add(int64(len(unparsed)))
+		for _, file := range unparsed {
+			img, err := imagefile.Open(file.Path)
+			if err != nil {
+				failed("failed opening image", file.Path, err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				img.Close()
+				return errors.Wrap(ctx.Err())
+			case imgChan <- queuedImage{ImageFile: file, img: img}:
+			}
 		}
+		return nil
+	}
 
-		switch path.Ext(fPath) {
-		case ".jpg", ".jpeg", ".png":
-		default:
+	err := opts.Walker.Walk(dirs, func(fPath string) error {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err)
+		}
+		if imagefile.IsArchive(fPath) {
+			entries, err := imagefile.ArchiveImages(fPath)
+			if err != nil {
+				// it's counted as a single image found, since we can't tell how many it has
+				prog.found.Add(1)
+				failed("failed reading archive", fPath, err)
+				return nil
+			}
+			for _, e := range entries {
+				batch = append(batch, db.ImageFile{Path: e.Path, Size: int64(e.UncompressedSize64), ModTime: e.Modified})
+			}
+		} else {
+			info, err := os.Stat(fPath)
+			if err != nil {
+				prog.found.Add(1)
+				failed("failed opening image", fPath, err)
+				return nil
+			}
+			batch = append(batch, db.ImageFile{Path: fPath, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		if len(batch) < filterBatchSize && time.Since(lastFlush) < filterBatchInterval {
 			return nil
 		}
-
-		imagePaths = append(imagePaths, fPath)
-		return nil
+		return flush()
 	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "filepath.WalkDir")
+		return errors.Wrap(err)
 	}
-	return imagePaths, nil
+	return errors.Wrap(flush())
 }
@@ -4,56 +4,72 @@ package ocr
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/base64"
 	"io"
 	"log/slog"
-	"os"
 
 	"github.com/danlock/gogosseract"
 	"github.com/danlock/pkg/errors"
-	"github.com/danlock/searmage/cfg"
 	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/hashing"
 )
 
-// setupWorkers creates a pool of gogosseract workers, and returns a worker function that parses the image, stores the result in sqlite and returns an error or nil to errChan.
-func setupWorkers(ctx context.Context, args cfg.Args) (WorkerFunc, error) {
+// setupWorkers creates a pool of gogosseract workers that lives until ctx is done, and returns a worker function that parses the image, stores the result in sqlite and returns an error or nil.
+func setupWorkers(ctx context.Context, opts Options) (WorkerFunc, error) {
 	gogoPoolCfg := gogosseract.PoolConfig{}
-	if args.TrainedData != nil {
-		gogoPoolCfg.Config.TrainingData = args.TrainedData
+	if opts.TrainedData != nil {
+		gogoPoolCfg.Config.TrainingData = opts.TrainedData
 	} else {
 		gogoPoolCfg.TrainingDataBytes = engTrainedData
 	}
 
-	ocr, err := gogosseract.NewPool(ctx, args.Workers, gogoPoolCfg)
+	ocr, err := gogosseract.NewPool(ctx, max(1, opts.Workers), gogoPoolCfg)
 	if err != nil {
 		return nil, errors.Wrap(err)
 	}
 	context.AfterFunc(ctx, ocr.Close)
 
-	return func(ctx context.Context, errChan chan<- error, img *os.File) (err error) {
-		defer img.Close()
-		defer func() { errChan <- err }()
+	return func(ctx context.Context, file db.ImageFile, img io.ReadSeeker) (err error) {
+		name := file.Path
+		hash, err := hashing.Sum(opts.Hash, img)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		// the image is decoded once for everything but Tesseract, which decodes it itself
+		decoded, format := decodeImage(name, img)
+		thumb := makeThumbnail(ctx, opts, name, decoded, hash)
+		md := makeMetadata(name, img, decoded, format)
 
-		hasher := md5.New()
-		io.Copy(hasher, img)
-		hash := "md5:" + base64.RawURLEncoding.EncodeToString(hasher.Sum([]byte{}))
+		// copies of an image share the text parsed from the first one
+		parsed := db.ParsedImage{Path: name, Size: file.Size, ModTime: file.ModTime, Hash: hash, Thumbnail: thumb, Metadata: md}
+		if opts.Barcodes {
+			parsed.Codes = scanCodes(name, decoded)
+		}
+		if linked, err := db.InsertDuplicate(ctx, opts.DB, opts.Roots, parsed); err != nil || linked {
+			return errors.Wrap(err)
+		}
 
 		_, err = img.Seek(0, io.SeekStart)
 		if err != nil {
 			return errors.Wrapf(err, "img.Seek")
 		}
 
-		text, err := ocr.ParseImage(ctx, img, gogosseract.ParseImageOptions{
+		// hOCR includes the bounding box of every word alongside the text
+		hocr, err := ocr.ParseImage(ctx, img, gogosseract.ParseImageOptions{
+			IsHOCR: true,
 			ProgressCB: func(i int32) {
-				slog.Debug("progress", "%", i, "path", img.Name())
+				slog.Debug("progress", "%", i, "path", name)
 			},
 		})
 		if err != nil {
 			return errors.Wrap(err)
 		}
+		text, words, err := parseHOCR(hocr)
+		if err != nil {
+			return errors.Wrap(err)
+		}
 
-		return errors.Wrap(db.InsertParsedText(ctx, args.DB, img.Name(), text, hash))
+		parsed.Text, parsed.Words = text, words
+		return errors.Wrap(db.InsertParsedText(ctx, opts.DB, opts.Roots, parsed))
 	}, nil
 
 }
@@ -4,40 +4,65 @@ package ocr
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/base64"
 	"io"
-	"os"
 
 	"github.com/danlock/pkg/errors"
-	"github.com/danlock/searmage/cfg"
 	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/hashing"
 	"github.com/otiai10/gosseract/v2"
 )
 
-// setupWorkers creates a pool of gosseract workers, and returns a worker function that parses the image, stores the result in sqlite and returns an error or nil to errChan.
-func setupWorkers(_ context.Context, args cfg.Args) (WorkerFunc, error) {
-	return func(ctx context.Context, errChan chan<- error, img *os.File) (err error) {
+// setupWorkers returns a worker function that parses the image with a new gosseract client, stores the result in sqlite and returns an error or nil.
+func setupWorkers(_ context.Context, opts Options) (WorkerFunc, error) {
+	return func(ctx context.Context, file db.ImageFile, img io.ReadSeeker) (err error) {
+		name := file.Path
 		tess := gosseract.NewClient()
 		defer tess.Close()
 
-		defer img.Close()
-		defer func() { errChan <- err }()
+		hash, err := hashing.Sum(opts.Hash, img)
+		if err != nil {
+			return errors.Wrap(err)
+		}
+		// the image is decoded once for everything but Tesseract, which decodes it itself
+		decoded, format := decodeImage(name, img)
+		thumb := makeThumbnail(ctx, opts, name, decoded, hash)
+		md := makeMetadata(name, img, decoded, format)
+
+		// copies of an image share the text parsed from the first one
+		parsed := db.ParsedImage{Path: name, Size: file.Size, ModTime: file.ModTime, Hash: hash, Thumbnail: thumb, Metadata: md}
+		if opts.Barcodes {
+			parsed.Codes = scanCodes(name, decoded)
+		}
+		if linked, err := db.InsertDuplicate(ctx, opts.DB, opts.Roots, parsed); err != nil || linked {
+			return errors.Wrap(err)
+		}
 
-		hasher := md5.New()
-		io.Copy(hasher, img)
-		hash := "md5:" + base64.RawURLEncoding.EncodeToString(hasher.Sum([]byte{}))
-		err = tess.SetImage(img.Name())
+		if _, err = img.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "img.Seek")
+		}
+		imgBytes, err := io.ReadAll(img)
 		if err != nil {
-			return errors.Wrapf(err, "tess.SetImage")
+			return errors.Wrapf(err, "io.ReadAll")
+		}
+		if err = tess.SetImageFromBytes(imgBytes); err != nil {
+			return errors.Wrapf(err, "tess.SetImageFromBytes")
 		}
 
 		text, err := tess.Text()
 		if err != nil {
 			return errors.Wrap(err)
 		}
+		boxes, err := tess.GetBoundingBoxes(gosseract.RIL_WORD)
+		if err != nil {
+			return errors.Wrapf(err, "tess.GetBoundingBoxes")
+		}
+		words := make([]db.WordBox, len(boxes))
+		for i, b := range boxes {
+			words[i] = db.WordBox{Text: b.Word, X0: b.Box.Min.X, Y0: b.Box.Min.Y, X1: b.Box.Max.X, Y1: b.Box.Max.Y, Confidence: b.Confidence}
+		}
 
-		return errors.Wrap(db.InsertParsedText(ctx, args.DB, img.Name(), text, hash))
+		parsed.Text, parsed.Words = text, words
+		return errors.Wrap(db.InsertParsedText(ctx, opts.DB, opts.Roots, parsed))
 	}, nil
 
 }
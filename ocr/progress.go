@@ -0,0 +1,153 @@
+package ocr
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ttyProgressInterval is how often the progress line is redrawn on a terminal.
+	ttyProgressInterval = 500 * time.Millisecond
+	// logProgressInterval is how often progress is logged when stderr isn't a terminal.
+	logProgressInterval = 10 * time.Second
+	// throughputWindow is how far back we look for the current throughput, so the ETA adapts to images getting bigger or smaller.
+	throughputWindow = 30 * time.Second
+)
+
+// progress tracks how parsing is going for reporting to the user.
+// found and failed are updated by the walking goroutine, everything else only by Parse's loop.
+type progress struct {
+	start   time.Time
+	found   atomic.Int64
+	failed  atomic.Int64
+	walking bool
+	parsed  int
+	// durations is how long each successfully parsed image took, for the summary's percentiles.
+	durations []time.Duration
+	// finishes is when each recent image finished, for the current throughput.
+	finishes []time.Time
+
+	out    io.Writer
+	isTTY  bool
+	drawn  bool
+	ticker *time.Ticker
+}
+
+// newProgress reports to out if it's set.
+func newProgress(out io.Writer) *progress {
+	p := &progress{start: time.Now(), walking: true, out: out}
+	if out == nil {
+		return p
+	}
+	if f, ok := out.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			p.isTTY = true
+		}
+	}
+	if p.isTTY {
+		p.ticker = time.NewTicker(ttyProgressInterval)
+	} else {
+		p.ticker = time.NewTicker(logProgressInterval)
+	}
+	return p
+}
+
+// tick fires whenever it's time to report, or never if we aren't reporting.
+func (p *progress) tick() <-chan time.Time {
+	if p.ticker == nil {
+		return nil
+	}
+	return p.ticker.C
+}
+
+// finished records the result of parsing an image.
+func (p *progress) finished(path string, took time.Duration, err error) {
+	if err != nil {
+		p.failed.Add(1)
+		p.clear()
+		slog.Warn("failed parsing image", "path", path, "err", err)
+		return
+	}
+	now := time.Now()
+	p.parsed++
+	p.durations = append(p.durations, took)
+	p.finishes = append(p.finishes, now)
+	// Only keep the finishes within the window around
+	if cutoff := slices.IndexFunc(p.finishes, func(t time.Time) bool { return now.Sub(t) <= throughputWindow }); cutoff > 0 {
+		p.finishes = slices.Delete(p.finishes, 0, cutoff)
+	}
+}
+
+// throughput returns images parsed per second over the throughputWindow, or since we started if that's shorter.
+func (p *progress) throughput() float64 {
+	window := min(time.Since(p.start), throughputWindow)
+	if window <= 0 {
+		return 0
+	}
+	return float64(len(p.finishes)) / window.Seconds()
+}
+
+// eta estimates how long the images found so far will take at the current throughput. It's 0 if we can't tell yet.
+func (p *progress) eta() time.Duration {
+	remaining := p.found.Load() - p.failed.Load() - int64(p.parsed)
+	rate := p.throughput()
+	if remaining <= 0 || rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// report shows the current progress, overwriting the last report on a terminal.
+func (p *progress) report() {
+	done := int64(p.parsed) + p.failed.Load()
+	total := fmt.Sprint(p.found.Load())
+	// While walking more images may still turn up
+	if p.walking {
+		total += "+"
+	}
+
+	if !p.isTTY {
+		slog.Info("progress", "done", done, "total", total, "failed", p.failed.Load(), "images/s", fmt.Sprintf("%.2f", p.throughput()), "eta", p.eta())
+		return
+	}
+
+	eta := "?"
+	if d := p.eta(); d > 0 {
+		eta = d.String()
+	}
+	fmt.Fprintf(p.out, "\r\033[Kparsed %d/%s images, %d failed, %.2f images/s, ETA %s", done, total, p.failed.Load(), p.throughput(), eta)
+	p.drawn = true
+}
+
+// clear erases the progress line on a terminal so logs aren't appended to it.
+func (p *progress) clear() {
+	if p.isTTY && p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// summary stops reporting and summarizes the parse.
+func (p *progress) summary() Report {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+	p.clear()
+
+	r := Report{Found: int(p.found.Load()), Parsed: p.parsed, Failed: int(p.failed.Load()), Duration: time.Since(p.start)}
+	if len(p.durations) == 0 {
+		return r
+	}
+
+	slices.Sort(p.durations)
+	percentile := func(pct int) time.Duration {
+		return p.durations[(len(p.durations)-1)*pct/100].Round(time.Millisecond)
+	}
+	r.P50, r.P90, r.P99, r.Max = percentile(50), percentile(90), percentile(99), percentile(100)
+	return r
+}
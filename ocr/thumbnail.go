@@ -0,0 +1,31 @@
+package ocr
+
+import (
+	"context"
+	"image"
+	"log/slog"
+
+	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/thumbnail"
+)
+
+// makeThumbnail generates a thumbnail of img, unless they're disabled or one is already stored for it's hash.
+// Failures are only logged since the image's text is still worth storing.
+func makeThumbnail(ctx context.Context, opts Options, name string, img image.Image, hash string) []byte {
+	if opts.ThumbSize == 0 || img == nil {
+		return nil
+	}
+	if has, err := db.HasThumbnail(ctx, opts.DB, hash); err != nil || has {
+		if err != nil {
+			slog.Warn("failed checking for thumbnail", "path", name, "err", err)
+		}
+		return nil
+	}
+
+	thumb, err := thumbnail.Encode(img, opts.ThumbSize)
+	if err != nil {
+		slog.Warn("failed generating thumbnail", "path", name, "err", err)
+		return nil
+	}
+	return thumb
+}
@@ -0,0 +1,203 @@
+package ocr
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/imagefile"
+)
+
+// Walker finds the images within directories.
+type Walker struct {
+	// Include limits images to those matching at least one of it's globs, if set. Exclude skips files and directories matching any of it's globs.
+	// Globs containing a slash match the path relative to the walked directory, otherwise they match the base name. ** matches any number of directories.
+	Include []string
+	Exclude []string
+	// SkipHidden skips files and directories starting with a dot.
+	SkipHidden bool
+	// FollowSymlinks walks into symlinked directories, only walking each directory once so symlink loops end.
+	// Symlinked images are parsed either way.
+	FollowSymlinks bool
+}
+
+// Walk calls fn with the path of every JPEG or PNG image, and every ZIP or CBZ archive, within dirs, honoring any IgnoreFileName along the way.
+// Images and archives within dirs are passed to fn as is, since they were asked for explicitly, but other files are still skipped.
+func (w Walker) Walk(dirs []string, fn func(path string) error) error {
+	state := walkState{Walker: w, fn: fn, visited: map[string]bool{}}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return errors.Wrapf(err, "os.Stat")
+		}
+		if info.IsDir() {
+			err = state.walkDir(dir, dir, nil)
+		} else if imagefile.IsImage(dir) || imagefile.IsArchive(dir) {
+			err = fn(dir)
+		} else {
+			slog.Debug("skipping file that isn't an image", "path", dir)
+		}
+		if err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// ReadPathList reads paths separated by newlines, or NUL characters if there are any, like the output of find -print0 or git ls-files -z.
+// Empty lines are ignored.
+func ReadPathList(r io.Reader) ([]string, error) {
+	list, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "io.ReadAll")
+	}
+
+	sep := "\n"
+	if bytes.IndexByte(list, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, p := range strings.Split(string(list), sep) {
+		// newline separated lists may come from Windows
+		if sep == "\n" {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+type walkState struct {
+	Walker
+	fn func(string) error
+	// visited holds the real path of directories already walked, so symlinks can't send us in circles.
+	visited map[string]bool
+}
+
+// walkDir walks dir, which is root or one of it's descendants. ignores are the ignore lists of dir's ancestors.
+func (w *walkState) walkDir(root, dir string, ignores []*ignoreList) error {
+	if w.FollowSymlinks {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return errors.Wrapf(err, "filepath.EvalSymlinks")
+		}
+		if w.visited[realDir] {
+			slog.Debug("skipping already walked directory", "path", dir, "real path", realDir)
+			return nil
+		}
+		w.visited[realDir] = true
+	}
+
+	list, err := readIgnoreFile(dir)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if list != nil {
+		ignores = append(ignores[:len(ignores):len(ignores)], list)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "os.ReadDir")
+	}
+
+	for _, e := range entries {
+		fPath := filepath.Join(dir, e.Name())
+		isDir := e.IsDir()
+		if e.Type()&fs.ModeSymlink != 0 {
+			// symlinked images are always parsed like filepath.WalkDir would, only symlinked directories need FollowSymlinks
+			info, err := os.Stat(fPath)
+			if err != nil {
+				slog.Debug("skipping broken symlink", "path", fPath, "err", err)
+				continue
+			}
+			if isDir = info.IsDir(); isDir && !w.FollowSymlinks {
+				slog.Debug("skipping symlinked directory", "path", fPath)
+				continue
+			} else if !isDir && !info.Mode().IsRegular() {
+				continue
+			}
+		} else if !isDir && !e.Type().IsRegular() {
+			continue
+		}
+
+		if w.skip(root, fPath, isDir, ignores) {
+			continue
+		}
+
+		if isDir {
+			if err = w.walkDir(root, fPath, ignores); err != nil {
+				return errors.Wrap(err)
+			}
+			continue
+		}
+
+		if err = w.fn(fPath); err != nil {
+			return errors.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// skip reports whether fPath is hidden, excluded, ignored, or if it's a file, not an included image or archive.
+func (w *walkState) skip(root, fPath string, isDir bool, ignores []*ignoreList) bool {
+	if w.SkipHidden && strings.HasPrefix(filepath.Base(fPath), ".") {
+		return true
+	}
+
+	if !isDir && !imagefile.IsImage(fPath) && !imagefile.IsArchive(fPath) {
+		return true
+	}
+
+	rel := relSlash(root, fPath)
+	for _, glob := range w.Exclude {
+		if matchesGlob(glob, rel) {
+			return true
+		}
+	}
+
+	ignored := false
+	for _, list := range ignores {
+		if listIgnored, matched := list.match(relSlash(list.dir, fPath), isDir); matched {
+			ignored = listIgnored
+		}
+	}
+	if ignored {
+		return true
+	}
+
+	if isDir || len(w.Include) == 0 {
+		return false
+	}
+	for _, glob := range w.Include {
+		if matchesGlob(glob, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesGlob matches globs containing a slash against the relative path, otherwise just the base name.
+func matchesGlob(glob, rel string) bool {
+	if strings.Contains(glob, "/") {
+		return matchGlob(strings.TrimPrefix(glob, "/"), rel)
+	}
+	return matchGlob(glob, path.Base(rel))
+}
+
+// relSlash returns fPath relative to dir with forward slashes, for matching against globs.
+func relSlash(dir, fPath string) string {
+	rel, err := filepath.Rel(dir, fPath)
+	if err != nil {
+		return filepath.ToSlash(fPath)
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,142 @@
+package searmage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/db"
+)
+
+// Query describes a search through the text of indexed images, the QR codes and barcodes found within them, and their tags and notes.
+type Query struct {
+	// Text uses FTS5 MATCH syntax (https://www.sqlite.org/fts5.html) and results are ordered by relevance,
+	// unless Regex is set, in which case it's a https://pkg.go.dev/regexp/syntax pattern and results are ordered by path.
+	Text  string
+	Regex bool
+	// Root limits results to images within the named root.
+	Root string
+	// PathPrefix limits results to images whose path starts with it.
+	PathPrefix string
+	// Limit and Offset paginate results. A Limit of 0 returns them all.
+	Limit  int
+	Offset int
+	// Snippets includes an excerpt of the text around the match in each Result, with the match wrapped in [brackets].
+	Snippets bool
+	// Format, Camera, TakenAfter, TakenBefore and HasLocation limit results by their Metadata, excluding images without it.
+	// Format is matched exactly, Camera as part of the make or model. TakenBefore is exclusive.
+	Format      string
+	Camera      string
+	TakenAfter  time.Time
+	TakenBefore time.Time
+	HasLocation bool
+	// Collapse returns copies of an image found at several paths as one Result, with the first matching path.
+	Collapse bool
+	// SimilarTo limits results to images whose perceptual hash (see Metadata.DHash) is within MaxDistance bits of it, most similar first.
+	// Text may be empty when it's set.
+	SimilarTo   *uint64
+	MaxDistance int
+	// Tags limits results to images with every one of these tags. Text may be empty when it's set.
+	Tags []string
+}
+
+// Metadata describes an image's format and size, and what it's EXIF says about how it was taken.
+type Metadata struct {
+	// Format is the image's format, such as jpeg or png.
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// TakenAt is when the photo was taken in the camera's local time, formatted as 2006-01-02T15:04:05.
+	TakenAt     string `json:"taken_at,omitempty"`
+	CameraMake  string `json:"camera_make,omitempty"`
+	CameraModel string `json:"camera_model,omitempty"`
+	// Orientation is the EXIF orientation, from 1 for upright to 8.
+	Orientation int      `json:"orientation,omitempty"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+	// DHash is a perceptual hash of the image as 16 hex digits, which differs by only a few bits between resized or re-saved copies.
+	DHash string `json:"dhash,omitempty"`
+}
+
+// newMetadata converts the db package's Metadata, which may be nil.
+func newMetadata(md *db.Metadata) *Metadata {
+	if md == nil {
+		return nil
+	}
+	m := Metadata(*md)
+	return &m
+}
+
+// Result is an indexed image matching a Query.
+type Result struct {
+	// ImageID identifies the image's text, which is shared by every copy of the image.
+	ImageID int64  `json:"image_id"`
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Snippet string `json:"snippet,omitempty"`
+	// Duplicates is how many other paths the image is also at, if Query.Collapse was set.
+	Duplicates int `json:"duplicates,omitempty"`
+	// Metadata is nil for images indexed before searmage stored it.
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// Searcher searches a database built by an Indexer, without ever writing to it.
+type Searcher struct {
+	db    *sql.DB
+	roots db.Roots
+}
+
+// NewSearcher opens the database at dbPath read only. It must have been written by this version of searmage.
+func NewSearcher(ctx context.Context, dbPath string) (*Searcher, error) {
+	sqlDB, err := db.SetupReadOnly(ctx, dbPath)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	roots, err := db.LoadRoots(ctx, sqlDB, nil)
+	if err != nil {
+		sqlDB.Close()
+		return nil, errors.Wrap(err)
+	}
+	return &Searcher{db: sqlDB, roots: roots}, nil
+}
+
+// Search returns the images matching q.
+func (s *Searcher) Search(ctx context.Context, q Query) ([]Result, error) {
+	dbQuery := db.Query{
+		Text:        q.Text,
+		Mode:        db.SearchMatch,
+		Root:        q.Root,
+		PathPrefix:  q.PathPrefix,
+		Limit:       q.Limit,
+		Offset:      q.Offset,
+		Snippets:    q.Snippets,
+		Format:      q.Format,
+		Camera:      q.Camera,
+		TakenAfter:  q.TakenAfter,
+		TakenBefore: q.TakenBefore,
+		HasLocation: q.HasLocation,
+		Collapse:    q.Collapse,
+		SimilarTo:   q.SimilarTo,
+		MaxDistance: q.MaxDistance,
+		Tags:        q.Tags,
+	}
+	if q.Regex {
+		dbQuery.Mode = db.SearchRegex
+	}
+
+	found, _, err := db.Search(ctx, s.db, s.roots, dbQuery)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	results := make([]Result, len(found))
+	for i, r := range found {
+		results[i] = Result{ImageID: r.ImageID, Path: r.Path, Hash: r.Hash, Snippet: r.Snippet, Duplicates: r.Duplicates, Metadata: newMetadata(r.Metadata)}
+	}
+	return results, nil
+}
+
+// Close closes the database.
+func (s *Searcher) Close() error {
+	return errors.Wrap(s.db.Close())
+}
@@ -0,0 +1,247 @@
+// Package searmage indexes the text within images using Tesseract OCR, and searches it using SQLite's FTS5.
+//
+// Indexer and Searcher are the stable API for embedding searmage within other tools.
+// The packages underneath them are used by the searmage command and may change between versions.
+package searmage
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/hashing"
+	"github.com/danlock/searmage/ocr"
+	"github.com/danlock/searmage/thumbnail"
+)
+
+// IndexerOptions configures an Indexer. Only DBPath is required.
+type IndexerOptions struct {
+	// DBPath is the SQLite database the index is stored in. It's created if it doesn't exist.
+	DBPath string
+	// Workers is how many images are parsed at once. Defaults to a third of the CPUs.
+	Workers uint
+	// TrainedData is the language data Tesseract uses, from https://github.com/tesseract-ocr/tessdata_fast. Defaults to English.
+	TrainedData io.Reader
+	// ThumbSize is the longest side of the thumbnails generated for images, in pixels. Defaults to thumbnail.DefaultSize, negative disables them.
+	ThumbSize int
+	// Hash identifies images by their content. Defaults to HashMD5, changing it for an existing database needs the rehash command so copies are still recognized.
+	Hash HashAlgorithm
+	// Barcodes decodes the QR codes and barcodes within images so they're searchable alongside the text, including images indexed before it was set.
+	Barcodes bool
+	// OverwriteEdits parses changed images again even if their text was corrected by hand, replacing the correction.
+	OverwriteEdits bool
+	// Roots names directories that image paths are stored relative to, mapping the name to the directory. They're saved in the database.
+	Roots map[string]string
+	// Include and Exclude are globs limiting which images within directories are indexed, see ocr.Walker.
+	Include []string
+	Exclude []string
+	// SkipHidden skips files and directories starting with a dot.
+	SkipHidden bool
+	// FollowSymlinks walks into symlinked directories. Symlinked images are indexed either way.
+	FollowSymlinks bool
+	// Progress is where Index reports how it's going, if set. Terminals get a progress line, anything else periodic logs.
+	Progress io.Writer
+	// OnIndexed is called with each image Index or IndexReader is done with, including the ones that failed.
+	// It's never called concurrently, so a slow OnIndexed holds up the others.
+	OnIndexed func(ctx context.Context, img IndexedImage)
+}
+
+// HashAlgorithm is how images are identified by their content, and the prefix of their hashes such as md5:.
+type HashAlgorithm string
+
+const (
+	HashMD5    HashAlgorithm = "md5"
+	HashSHA256 HashAlgorithm = "sha256"
+	// HashBLAKE2b is BLAKE2b-256, about as fast as MD5 but without it's collisions.
+	HashBLAKE2b HashAlgorithm = "blake2b"
+	// HashXXHash is XXH64, the fastest but not meant to resist deliberate collisions.
+	HashXXHash HashAlgorithm = "xxhash"
+)
+
+// SavedSearch is a named search saved with the searmage command's save-search.
+type SavedSearch struct {
+	Name string
+	// Text and Regex are the saved search's Query.Text and Query.Regex.
+	Text  string
+	Regex bool
+}
+
+// IndexedImage is an image Index or IndexReader is done with.
+type IndexedImage struct {
+	Path string
+	// Err is why the image couldn't be indexed. The other fields are only set if it's nil.
+	Err     error
+	ImageID int64
+	Hash    string
+	Text    string
+	// Matches are the saved searches the image matches.
+	Matches []SavedSearch
+}
+
+// Indexer parses images and stores their text in a database.
+// It's the only process allowed to write to the database until it's closed.
+type Indexer struct {
+	db     *sql.DB
+	unlock func() error
+	parser *ocr.Parser
+}
+
+// IndexReport summarizes an Index call, including percentiles of how long each image took to parse.
+type IndexReport struct {
+	// Found is how many images weren't indexed yet.
+	Found    int
+	Indexed  int
+	Failed   int
+	Duration time.Duration
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// NewIndexer opens the database, creating it if needed, and locks it for writing.
+func NewIndexer(ctx context.Context, opts IndexerOptions) (_ *Indexer, err error) {
+	if opts.DBPath == "" {
+		return nil, errors.New("IndexerOptions.DBPath is required")
+	}
+	if opts.Workers == 0 {
+		opts.Workers = uint(max(1, runtime.NumCPU()/3))
+	}
+	if opts.ThumbSize == 0 {
+		opts.ThumbSize = thumbnail.DefaultSize
+	} else if opts.ThumbSize < 0 {
+		opts.ThumbSize = 0
+	}
+
+	alg := hashing.Default
+	if opts.Hash != "" {
+		if alg, err = hashing.ParseAlgorithm(string(opts.Hash)); err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
+
+	ix := &Indexer{}
+	if ix.unlock, err = db.LockWriter(opts.DBPath); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer func() {
+		if err != nil {
+			ix.Close()
+		}
+	}()
+
+	if ix.db, err = db.Setup(ctx, opts.DBPath); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	for name, rootPath := range opts.Roots {
+		if err = db.SetRoot(ctx, ix.db, name, rootPath); err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
+	roots, err := db.LoadRoots(ctx, ix.db, nil)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	parserOpts := ocr.Options{
+		DB:             ix.db,
+		Roots:          roots,
+		Workers:        opts.Workers,
+		TrainedData:    opts.TrainedData,
+		ThumbSize:      opts.ThumbSize,
+		Hash:           alg,
+		Barcodes:       opts.Barcodes,
+		OverwriteEdits: opts.OverwriteEdits,
+		Walker: ocr.Walker{
+			Include:        opts.Include,
+			Exclude:        opts.Exclude,
+			SkipHidden:     opts.SkipHidden,
+			FollowSymlinks: opts.FollowSymlinks,
+		},
+		Progress: opts.Progress,
+	}
+	if opts.OnIndexed != nil {
+		parserOpts.OnParsed = ix.onParsed(roots, alg, opts.OnIndexed)
+	}
+	ix.parser = ocr.NewParser(parserOpts)
+	return ix, nil
+}
+
+// onParsed looks up the image parsed at path along with the saved searches it matches, and passes it to onIndexed.
+func (ix *Indexer) onParsed(roots db.Roots, alg hashing.Algorithm, onIndexed func(context.Context, IndexedImage)) func(context.Context, string, error) {
+	return func(ctx context.Context, path string, err error) {
+		img := IndexedImage{Path: path, Err: err}
+		if err == nil {
+			if err = ix.lookup(ctx, roots, alg, &img); err != nil {
+				slog.Warn("failed looking up indexed image", "path", path, "err", err)
+			}
+		}
+		onIndexed(ctx, img)
+	}
+}
+
+// lookup fills in img with what was stored for it's path, and the saved searches it matches.
+func (ix *Indexer) lookup(ctx context.Context, roots db.Roots, alg hashing.Algorithm, img *IndexedImage) (err error) {
+	if img.ImageID, img.Hash, err = db.FindImage(ctx, ix.db, roots, img.Path, alg); err != nil {
+		return errors.Wrap(err)
+	}
+	stored, err := db.GetImage(ctx, ix.db, roots, img.ImageID)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	img.Text = stored.Text
+	searches, err := db.SavedSearches(ctx, ix.db)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	matches, err := db.MatchSavedSearches(ctx, ix.db, searches, img.ImageID)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	for _, m := range matches {
+		img.Matches = append(img.Matches, SavedSearch{Name: m.Name, Text: m.Text, Regex: m.Mode == db.SearchRegex})
+	}
+	return nil
+}
+
+// Index parses the images within paths that aren't indexed yet. Paths may be directories to walk or image files.
+// Images that fail to parse are logged and counted in the report instead of stopping the others.
+func (ix *Indexer) Index(ctx context.Context, paths []string) (IndexReport, error) {
+	r, err := ix.parser.ParseDirs(ctx, paths)
+	return IndexReport{
+		Found:    r.Found,
+		Indexed:  r.Parsed,
+		Failed:   r.Failed,
+		Duration: r.Duration,
+		P50:      r.P50,
+		P90:      r.P90,
+		P99:      r.P99,
+		Max:      r.Max,
+	}, errors.Wrap(err)
+}
+
+// IndexReader parses the image read from r and stores it's text under name, replacing anything stored under name before.
+// name is usually the image's path, but doesn't have to exist.
+func (ix *Indexer) IndexReader(ctx context.Context, name string, r io.Reader) error {
+	return errors.Wrap(ix.parser.ParseReader(ctx, name, r))
+}
+
+// Close stops the Tesseract workers, closes the database and unlocks it.
+func (ix *Indexer) Close() error {
+	if ix.parser != nil {
+		ix.parser.Close()
+	}
+	var err error
+	if ix.db != nil {
+		err = ix.db.Close()
+	}
+	if unlockErr := ix.unlock(); unlockErr != nil {
+		slog.Debug("Indexer.Close unlock", "err", unlockErr)
+	}
+	return errors.Wrap(err)
+}
@@ -0,0 +1,371 @@
+// Package server serves searches through a searmage database as JSON over HTTP, along with a web UI for browsing them.
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp/syntax"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danlock/pkg/errors"
+	"github.com/danlock/searmage/db"
+	"github.com/danlock/searmage/imagefile"
+	"github.com/danlock/searmage/thumbnail"
+	"github.com/ncruces/go-sqlite3"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+	// shutdownTimeout is how long in flight requests get to finish after we're told to stop.
+	shutdownTimeout = 10 * time.Second
+	// maxEditBytes limits the body of PUT /images/{id}/text.
+	maxEditBytes = 1 << 20
+)
+
+// Server handles requests using a database, ideally opened with db.SetupReadOnly unless AllowEdits is set.
+type Server struct {
+	DB    *sql.DB
+	Roots db.Roots
+	// ThumbSize is the size of thumbnails generated for images that were indexed without one, thumbnail.DefaultSize if unset.
+	ThumbSize int
+	// AllowEdits enables correcting an image's text with PUT and DELETE /images/{id}/text, for which DB must be writable.
+	// Edits take the writer lock of the database at DBPath while they're saved, like the edit command.
+	AllowEdits bool
+	DBPath     string
+	editMu     sync.Mutex
+}
+
+// Handler routes requests to the Server's endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", s.search)
+	mux.HandleFunc("GET /images/{id}", s.image)
+	mux.HandleFunc("GET /images/{id}/file", s.imageFile)
+	mux.HandleFunc("GET /images/{id}/thumbnail", s.imageThumbnail)
+	mux.HandleFunc("PUT /images/{id}/text", s.editText)
+	mux.HandleFunc("DELETE /images/{id}/text", s.editText)
+	mux.HandleFunc("GET /stats", s.stats)
+	mux.HandleFunc("GET /{$}", s.ui)
+	return mux
+}
+
+// ListenAndServe serves h on addr until ctx is done, then gracefully shuts down.
+func ListenAndServe(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: 10 * time.Second}
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- srv.ListenAndServe() }()
+	slog.Info("serving...", "addr", addr)
+
+	select {
+	case err := <-errChan:
+		return errors.Wrapf(err, "srv.ListenAndServe")
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down...", "addr", addr)
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	return errors.Wrapf(srv.Shutdown(shutdownCtx), "srv.Shutdown")
+}
+
+// SearchResponse is the body returned by /search.
+type SearchResponse struct {
+	Total   int               `json:"total"`
+	Limit   int               `json:"limit"`
+	Offset  int               `json:"offset"`
+	Results []db.SearchResult `json:"results"`
+}
+
+// search takes the query parameters q, mode (match or regex), root, path_prefix, limit, offset and snippets (true by default), along with tag which may be repeated.
+// highlight_start and highlight_end replace the markers wrapping matches within snippets.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := db.Query{
+		Text:       params.Get("q"),
+		Mode:       db.SearchMode(params.Get("mode")),
+		Root:       params.Get("root"),
+		PathPrefix: params.Get("path_prefix"),
+		Limit:      defaultLimit,
+		Snippets:   params.Get("snippets") != "false",
+		Highlight:  [2]string{params.Get("highlight_start"), params.Get("highlight_end")},
+		Tags:       params["tag"],
+	}
+	if q.Text == "" && params.Get("similar_to") == "" && len(q.Tags) == 0 {
+		writeError(w, http.StatusBadRequest, "q, similar_to or tag is required")
+		return
+	}
+	if (q.Highlight[0] == "") != (q.Highlight[1] == "") {
+		writeError(w, http.StatusBadRequest, "highlight_start and highlight_end must be set together")
+		return
+	}
+	if q.Mode != "" && q.Mode != db.SearchMatch && q.Mode != db.SearchRegex {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("mode must be %s or %s", db.SearchMatch, db.SearchRegex))
+		return
+	}
+
+	q.Format, q.Camera, q.HasLocation = params.Get("format"), params.Get("camera"), params.Get("has_location") == "true"
+	q.Collapse = params.Get("collapse") == "true"
+	var err error
+	if !s.parseSimilarTo(w, r, &q) {
+		return
+	}
+	for param, t := range map[string]*time.Time{"taken_after": &q.TakenAfter, "taken_before": &q.TakenBefore} {
+		if v := params.Get(param); v != "" {
+			if *t, err = db.ParseTakenAt(v); err != nil {
+				writeError(w, http.StatusBadRequest, param+" must be a date like 2006-01-02 or time like 2006-01-02T15:04:05")
+				return
+			}
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 || q.Limit > maxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+			return
+		}
+	}
+	if offset := params.Get("offset"); offset != "" {
+		if q.Offset, err = strconv.Atoi(offset); err != nil || q.Offset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+
+	results, total, err := db.Search(r.Context(), s.DB, s.Roots, q)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	if results == nil {
+		results = []db.SearchResult{}
+	}
+	writeJSON(w, http.StatusOK, SearchResponse{Total: total, Limit: q.Limit, Offset: q.Offset, Results: results})
+}
+
+// defaultMaxDistance is how many bits perceptual hashes may differ by for similar_to, if max_distance isn't set.
+const defaultMaxDistance = 10
+
+// parseSimilarTo limits q to images that look like the image whose id is the similar_to parameter, writing an error response if it can't.
+func (s *Server) parseSimilarTo(w http.ResponseWriter, r *http.Request, q *db.Query) bool {
+	params := r.URL.Query()
+	if params.Get("similar_to") == "" {
+		return true
+	}
+	id, err := strconv.ParseInt(params.Get("similar_to"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "similar_to must be an image id")
+		return false
+	}
+	q.MaxDistance = defaultMaxDistance
+	if d := params.Get("max_distance"); d != "" {
+		if q.MaxDistance, err = strconv.Atoi(d); err != nil || q.MaxDistance < 0 || q.MaxDistance > 64 {
+			writeError(w, http.StatusBadRequest, "max_distance must be between 0 and 64")
+			return false
+		}
+	}
+
+	img, err := db.GetImage(r.Context(), s.DB, s.Roots, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("image %d not found", id))
+		return false
+	} else if err != nil {
+		writeInternalError(w, err)
+		return false
+	}
+	if img.Metadata == nil || img.Metadata.DHash == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("image %d has no perceptual hash yet, index it again to add one", id))
+		return false
+	}
+	dhash, err := db.ParseDHash(img.Metadata.DHash)
+	if err != nil {
+		writeInternalError(w, err)
+		return false
+	}
+	q.SimilarTo = &dhash
+	return true
+}
+
+// writeQueryError blames the client for errors from invalid queries, such as bad FTS5 or regexp syntax.
+func writeQueryError(w http.ResponseWriter, err error) {
+	if regexErr, ok := errors.Into[*syntax.Error](err); ok {
+		writeError(w, http.StatusBadRequest, regexErr.Error())
+	} else if sqliteErr, ok := errors.Into[*sqlite3.Error](err); ok && errors.Is(err, sqlite3.ERROR) {
+		writeError(w, http.StatusBadRequest, sqliteErr.Error())
+	} else {
+		writeInternalError(w, err)
+	}
+}
+
+func (s *Server) image(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.getImage(w, r)
+	if ok {
+		writeJSON(w, http.StatusOK, img)
+	}
+}
+
+// imageFile serves the image itself from the first of it's paths that still exists.
+func (s *Server) imageFile(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.getImage(w, r)
+	if !ok {
+		return
+	}
+
+	f, fPath, err := openImage(img)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("image %d isn't at any of it's paths anymore", img.ID))
+		return
+	}
+	defer f.Close()
+
+	// the hash identifies the image's contents, so it makes a fine ETag, and entries within archives don't have a modification time of their own
+	w.Header().Set("ETag", strconv.Quote(img.Hash))
+	http.ServeContent(w, r, fPath, time.Time{}, f)
+}
+
+// imageThumbnail serves the image's stored thumbnail, or generates one if it was indexed without it.
+func (s *Server) imageThumbnail(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.getImage(w, r)
+	if !ok {
+		return
+	}
+
+	thumb, err := db.GetThumbnail(r.Context(), s.DB, img.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the database is read only, so the generated thumbnail can't be stored for next time
+		f, _, err := openImage(img)
+		if err != nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("image %d isn't at any of it's paths anymore", img.ID))
+			return
+		}
+		defer f.Close()
+
+		size := s.ThumbSize
+		if size <= 0 {
+			size = thumbnail.DefaultSize
+		}
+		if thumb, err = thumbnail.Generate(f, size); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+	} else if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", strconv.Quote("thumbnail:"+img.Hash))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(thumb))
+}
+
+// openImage opens the first of the image's paths that still exists, returning it's path.
+func openImage(img db.Image) (imagefile.ReadSeekCloser, string, error) {
+	err := errors.New("image has no paths")
+	for _, path := range img.Paths {
+		var f imagefile.ReadSeekCloser
+		if f, err = imagefile.Open(path); err == nil {
+			return f, path, nil
+		}
+	}
+	return nil, "", errors.Wrap(err)
+}
+
+// getImage gets the image for the id in the request's path, writing an error response if it can't.
+func (s *Server) getImage(w http.ResponseWriter, r *http.Request) (img db.Image, ok bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "id must be an integer")
+		return img, false
+	}
+
+	img, err = db.GetImage(r.Context(), s.DB, s.Roots, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("image %d not found", id))
+		return img, false
+	} else if err != nil {
+		writeInternalError(w, err)
+		return img, false
+	}
+	return img, true
+}
+
+// EditRequest is the body of PUT /images/{id}/text.
+type EditRequest struct {
+	Text string `json:"text"`
+}
+
+// editText corrects an image's text with PUT, or restores the text Tesseract parsed with DELETE, responding with the updated image.
+func (s *Server) editText(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowEdits {
+		writeError(w, http.StatusForbidden, "editing is disabled, serve with -allow-edits to enable it")
+		return
+	}
+	img, ok := s.getImage(w, r)
+	if !ok {
+		return
+	}
+	var req EditRequest
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEditBytes)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, `expected a JSON body like {"text": "corrected text"}`)
+			return
+		}
+	}
+
+	// the writer lock can't be taken twice within a process, so our own requests wait their turn instead of failing
+	s.editMu.Lock()
+	defer s.editMu.Unlock()
+	unlock, err := db.LockWriter(s.DBPath)
+	if err != nil {
+		writeError(w, http.StatusConflict, "another searmage process is writing to the database, try again later")
+		return
+	}
+	defer unlock()
+
+	if r.Method == http.MethodPut {
+		err = db.EditText(r.Context(), s.DB, img.ID, req.Text)
+	} else {
+		err = db.RevertEdit(r.Context(), s.DB, img.ID)
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if img, ok = s.getImage(w, r); ok {
+		writeJSON(w, http.StatusOK, img)
+	}
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := db.GetStats(r.Context(), s.DB)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("writeJSON", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// writeInternalError logs err instead of exposing it's details to the client.
+func writeInternalError(w http.ResponseWriter, err error) {
+	slog.Error("server", "err", err)
+	writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
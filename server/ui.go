@@ -0,0 +1,17 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiHTML is a single page app for browsing searches, with everything inlined so it works offline.
+//
+//go:embed ui/index.html
+var uiHTML []byte
+
+func (s *Server) ui(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'; img-src 'self'")
+	w.Write(uiHTML)
+}
@@ -0,0 +1,92 @@
+// Package thumbnail shrinks images into small JPEGs for previews.
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/danlock/pkg/errors"
+)
+
+// DefaultSize is the default length of a thumbnail's longest side, in pixels.
+const DefaultSize = 256
+
+const jpegQuality = 80
+
+// Generate decodes an image and encodes it as a JPEG scaled down to fit within a size by size square.
+// Images that already fit aren't scaled up. Transparent areas become white.
+func Generate(r io.Reader, size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, errors.Errorf("invalid thumbnail size %d", size)
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "image.Decode")
+	}
+	return Encode(src, size)
+}
+
+// Encode is Generate for an image that's already decoded.
+func Encode(src image.Image, size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, errors.Errorf("invalid thumbnail size %d", size)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scale(src, size), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, errors.Wrapf(err, "jpeg.Encode")
+	}
+	return buf.Bytes(), nil
+}
+
+// scale shrinks src to fit within size by averaging the source pixels covered by each destination pixel, which looks much better than nearest neighbor when downscaling.
+func scale(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+
+	// RGBA64At avoids allocating a color.Color per pixel, which matters for multi-megapixel photos.
+	at := func(x, y int) color.RGBA64 {
+		r, g, b, a := src.At(x, y).RGBA()
+		return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+	}
+	if fast, ok := src.(image.RGBA64Image); ok {
+		at = fast.RGBA64At
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := b.Min.Y+dy*sh/dh, b.Min.Y+max((dy+1)*sh/dh, dy*sh/dh+1)
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := b.Min.X+dx*sw/dw, b.Min.X+max((dx+1)*sw/dw, dx*sw/dw+1)
+
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					c := at(x, y)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			// the colors are alpha premultiplied, so compositing over white just adds the missing alpha to each
+			white := 0xffff*n - a
+			dst.SetRGBA(dx, dy, color.RGBA{
+				R: uint8((r + white) / n >> 8),
+				G: uint8((g + white) / n >> 8),
+				B: uint8((bl + white) / n >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}